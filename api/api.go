@@ -1,58 +1,202 @@
 package api
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
 
 	"github.com/goccy/go-json"
-	"github.com/redis/go-redis/v9"
 
 	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cursor"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Options configures the server, zero timeouts are disabled and zero page
+// sizes use the handler defaults
+type Options struct {
+	// Address is the host:port to listen on
+	Address string
+	// CursorKey signs the pagination tokens and must be the same on every
+	// instance behind the load balancer
+	CursorKey []byte
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout bounds how long Stop waits for the in-flight requests,
+	// their contexts are then canceled and they are answered with 503
+	ShutdownTimeout time.Duration
+	// CheckTimeout bounds the store probe of /readyz
+	CheckTimeout time.Duration
+	// DrainDelay is how long Stop keeps serving while /readyz reports the
+	// server as stopping, so the load balancer sends its requests elsewhere
+	DrainDelay time.Duration
+	// RequestTimeout is the deadline of the context every store call of a
+	// request receives, RouteTimeouts overrides it by route, keyed as
+	// "GET /pessoas/:id". Expired requests are answered with 504. The export
+	// streams as long as it takes and has no deadline, the batch of POST
+	// /pessoas/lote has a minute unless RouteTimeouts sets its own.
+	RequestTimeout time.Duration
+	RouteTimeouts  map[string]time.Duration
+
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// Metrics exports the HTTP metrics, and those registered by the caller,
+	// on /metrics. There is no /metrics when nil.
+	Metrics *prometheus.Registry
+
+	// TracerProvider creates a span for every request, passed to the store
+	// in the request context. Requests are not traced when nil.
+	TracerProvider trace.TracerProvider
+
+	// Logger logs the failed requests, and AccessLogSampleRatio of the
+	// others. slog.Default() when nil.
+	Logger               *slog.Logger
+	AccessLogSampleRatio float64
+}
+
 type Server struct {
 	Port     string `json:"port"`
 	fiberApp *fiber.App
 	store    persistence.Store
+	options  Options
+
+	cursors *cursor.Codec
+
+	checks   []Check
+	stopping atomic.Bool
 
-	cache *redis.Client
+	// requests is the parent of the context of every request, canceled by
+	// Stop once ShutdownTimeout expires
+	requests       context.Context
+	cancelRequests context.CancelFunc
+
+	onStop []func() error
+}
+
+// AddCheck adds a dependency probed by /readyz, before Start
+func (s *Server) AddCheck(check Check) {
+	s.checks = append(s.checks, check)
+}
+
+// OnStop registers fn to run when the server stops, after the in-flight
+// requests are done
+func (s *Server) OnStop(fn func() error) {
+	s.onStop = append(s.onStop, fn)
 }
 
 func (s *Server) Stop() error {
-	return s.fiberApp.Shutdown()
+	s.stopping.Store(true)
+
+	if s.options.DrainDelay > 0 {
+		time.Sleep(s.options.DrainDelay)
+	}
+
+	var err error
+	if s.options.ShutdownTimeout > 0 {
+		err = s.fiberApp.ShutdownWithTimeout(s.options.ShutdownTimeout)
+		// the requests still running give up and are retried elsewhere
+		s.cancelRequests()
+	} else {
+		err = s.fiberApp.Shutdown()
+	}
+
+	for _, fn := range s.onStop {
+		if stopErr := fn(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+
+	return err
 }
 
 func (s *Server) Start() error {
+	s.setupApp()
 
+	s.options.Logger.Info("Server listening", "address", s.Port)
+
+	return s.fiberApp.Listen(s.Port)
+}
+
+// setupApp creates the fiber app and registers the routes
+func (s *Server) setupApp() {
 	s.fiberApp = fiber.New(
 		fiber.Config{
-			JSONEncoder: json.Marshal,
-			JSONDecoder: json.Unmarshal,
-			//ReadTimeout:  30 * time.Millisecond,
-			//WriteTimeout: 20 * time.Millisecond,
-			//IdleTimeout:  30 * time.Second,
+			JSONEncoder:  json.Marshal,
+			JSONDecoder:  json.Unmarshal,
+			ReadTimeout:  s.options.ReadTimeout,
+			WriteTimeout: s.options.WriteTimeout,
+			IdleTimeout:  s.options.IdleTimeout,
+			// the bodies over the limit are streamed rather than refused,
+			// the routes bound their own, see withBodyLimit
+			StreamRequestBody: true,
 		},
 	)
 
-	handler := PeopleHandler{store: s.store, cache: s.cache}
+	handler := PeopleHandler{
+		store:           s.store,
+		cursors:         s.cursors,
+		defaultPageSize: s.options.DefaultPageSize,
+		maxPageSize:     s.options.MaxPageSize,
+		logger:          s.options.Logger,
+		lookupTimeout:   s.routeTimeout(fiber.MethodGet, "/pessoas/:id"),
+	}
+
+	s.fiberApp.Use(s.requestContext)
+	s.fiberApp.Use(requestID)
 
-	s.fiberApp.Get("contagem-pessoas", handler.GetPeopleCount)
-	s.fiberApp.Post("/pessoas", handler.AddPerson)
-	s.fiberApp.Get("/pessoas", handler.GetPeople)
-	s.fiberApp.Get("/pessoas/:id", handler.GetPerson)
+	if s.options.TracerProvider != nil {
+		s.fiberApp.Use(newHTTPTracing(s.options.TracerProvider).middleware)
+	}
 
-	log.Println("Server listening on port", s.Port)
+	if s.options.Metrics != nil {
+		s.fiberApp.Use(newHTTPMetrics(s.options.Metrics).middleware)
+		s.fiberApp.Get("/metrics", metricsHandler(s.options.Metrics))
+	}
 
-	return s.fiberApp.Listen(s.Port)
+	access := &accessLog{logger: s.options.Logger, ratio: s.options.AccessLogSampleRatio}
+	s.fiberApp.Use(access.middleware)
+
+	s.fiberApp.Get("/healthz", s.Healthz)
+	s.fiberApp.Get("/readyz", s.Readyz)
+
+	s.handle(fiber.MethodGet, "/contagem-pessoas", handler.GetPeopleCount)
+	s.handle(fiber.MethodPost, "/pessoas", handler.AddPerson)
+	// the batch is decoded as it arrives, it has no body limit
+	s.fiberApp.Post("/pessoas/lote", withTimeout(s.routeTimeout(fiber.MethodPost, "/pessoas/lote"), handler.AddPeople))
+	s.handle(fiber.MethodGet, "/pessoas", handler.GetPeople)
+	// registered before /pessoas/:id, which would match it too. The people
+	// are read while the response is sent, after the handler returned, so
+	// the route has no deadline.
+	s.fiberApp.Get("/pessoas/export", handler.ExportPeople)
+	s.handle(fiber.MethodGet, "/pessoas/:id", handler.GetPerson)
+	s.handle(fiber.MethodPut, "/pessoas/:id", handler.UpdatePerson)
+	s.handle(fiber.MethodPatch, "/pessoas/:id", handler.PatchPerson)
+	s.handle(fiber.MethodDelete, "/pessoas/:id", handler.DeletePerson)
 }
 
-func New(store persistence.Store, port string, redisAddress string) *Server {
+// New creates a server for the store
+func New(store persistence.Store, options Options) *Server {
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+
+	requests, cancelRequests := context.WithCancel(context.Background())
+
 	return &Server{
-		Port:  ":" + port,
-		store: store,
-		cache: redis.NewClient(&redis.Options{
-			Addr: redisAddress,
-		}),
+		Port:    options.Address,
+		store:   store,
+		options: options,
+		cursors: cursor.NewCodec(options.CursorKey),
+		checks:  []Check{{Name: "store", Timeout: options.CheckTimeout, Probe: store.Ping}},
+
+		requests:       requests,
+		cancelRequests: cancelRequests,
 	}
 }
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var ErrBodyTooLarge = errors.New("Corpo da requisição muito grande")
+
+// bodyLimit bounds the body of the routes that read it whole. The server
+// streams every body so POST /pessoas/lote can decode its entries as they
+// arrive, whatever its size.
+const bodyLimit = fiber.DefaultBodyLimit
+
+// requestBody returns the body of the request as it arrives, read from the
+// connection when the server streams it
+func requestBody(ctx *fiber.Ctx) io.Reader {
+	if stream := ctx.Context().RequestBodyStream(); stream != nil {
+		return stream
+	}
+	return bytes.NewReader(ctx.Body())
+}
+
+// withBodyLimit answers 413 to the requests whose body is over limit, before
+// the handler reads it. A chunked body is read up to the limit to know its
+// size.
+func withBodyLimit(limit int, handler fiber.Handler) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		length := ctx.Request().Header.ContentLength()
+
+		if length < 0 {
+			body, err := io.ReadAll(io.LimitReader(requestBody(ctx), int64(limit)+1))
+			if err != nil {
+				ctx.Context().SetConnectionClose()
+				return ctx.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: err.Error()})
+			}
+
+			length = len(body)
+			ctx.Request().SetBodyRaw(body)
+		}
+
+		if length > limit {
+			// the rest of the body is left unread on the connection
+			ctx.Context().SetConnectionClose()
+			return ctx.Status(fiber.StatusRequestEntityTooLarge).JSON(ErrorResponse{Error: ErrBodyTooLarge.Error()})
+		}
+
+		return handler(ctx)
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"rinha-backend-go/persistence/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchReader(t *testing.T) {
+	read := func(body string) ([]string, error) {
+		batch := NewBatchReader(strings.NewReader(body))
+
+		var entries []string
+		for {
+			entry, err := batch.Next()
+			if err == io.EOF {
+				return entries, nil
+			}
+			if err != nil {
+				return entries, err
+			}
+			entries = append(entries, string(entry))
+		}
+	}
+
+	entries, err := read(" \n[{\"a\": 1}, 2 ,\"x\"]\n")
+	require.NoError(t, err)
+	require.Equal(t, []string{`{"a": 1}`, "2", `"x"`}, entries)
+
+	entries, err = read("{\"a\": 1}\r\n\n  {\"b\"\n")
+	require.NoError(t, err)
+	require.Equal(t, []string{`{"a": 1}`, `{"b"`}, entries)
+
+	entries, err = read("")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	_, err = read(`[1, 2`)
+	require.ErrorIs(t, err, ErrInvalidBatch)
+
+	_, err = read(`[1] 2`)
+	require.ErrorIs(t, err, ErrInvalidBatch)
+
+	_, err = read(strings.Repeat("x", maxBatchEntrySize+1))
+	require.ErrorIs(t, err, ErrInvalidBatch)
+}
+
+// unsized hides the length of the body, which is then sent chunked
+type unsized struct{ io.Reader }
+
+func TestBodyLimit(t *testing.T) {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+
+	server := New(store, Options{})
+	server.setupApp()
+
+	send := func(path string, body io.Reader) *http.Response {
+		req, err := http.NewRequest("POST", path, body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if _, ok := body.(unsized); ok {
+			req.TransferEncoding = []string{"chunked"}
+		}
+
+		resp, err := server.fiberApp.Test(req, -1)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	// a batch well over the limit of the other routes, sized and chunked
+	var batch strings.Builder
+	for i := 0; batch.Len() <= 2*bodyLimit; i++ {
+		nickname := "lote"
+		for n := i; n > 0; n /= 26 {
+			nickname += string(rune('a' + n%26))
+		}
+		fmt.Fprintf(&batch, "{\"nome\": \"Jane Doe\", \"apelido\": %q, \"nascimento\": \"1990-01-01\", \"stack\": [\"Go\"]}\n", nickname)
+	}
+	entries := strings.Count(batch.String(), "\n")
+
+	for _, body := range []io.Reader{strings.NewReader(batch.String()), unsized{strings.NewReader(batch.String())}} {
+		resp := send("/pessoas/lote", body)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var response AddPeopleResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		require.Len(t, response.Resultados, entries)
+	}
+
+	count, err := store.GetPeopleCount(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, entries, count)
+
+	large := `{"nome": "` + strings.Repeat("x", bodyLimit) + `"}`
+
+	resp := send("/pessoas", strings.NewReader(large))
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = send("/pessoas", unsized{strings.NewReader(large)})
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// a chunked body under the limit is read whole
+	resp = send("/pessoas", unsized{strings.NewReader(`{"nome": "Jane Doe", "apelido": "chunked", "nascimento": "1990-01-01"}`)})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	ErrRequestTimeout  = errors.New("Tempo limite da requisição excedido")
+	ErrRequestCanceled = errors.New("Requisição cancelada")
+)
+
+// defaultRouteTimeouts are the deadlines of the routes whose work grows with
+// the request rather than RequestTimeout
+var defaultRouteTimeouts = map[string]time.Duration{
+	"POST /pessoas/lote": time.Minute,
+}
+
+// routeTimeout returns the deadline of the route registered for method and
+// path, the RouteTimeouts entry when there is one
+func (s *Server) routeTimeout(method string, path string) time.Duration {
+	if timeout, ok := s.options.RouteTimeouts[method+" "+path]; ok {
+		return timeout
+	}
+	if timeout, ok := defaultRouteTimeouts[method+" "+path]; ok {
+		return timeout
+	}
+	return s.options.RequestTimeout
+}
+
+// handle registers the handler of a route bounded by its deadline and the
+// body limit
+func (s *Server) handle(method string, path string, handler fiber.Handler) {
+	s.fiberApp.Add(method, path, withTimeout(s.routeTimeout(method, path), withBodyLimit(bodyLimit, handler)))
+}
+
+// requestContext derives the context of the request from the server, so Stop
+// can cancel it
+func (s *Server) requestContext(ctx *fiber.Ctx) error {
+	ctx.SetUserContext(s.requests)
+	return ctx.Next()
+}
+
+// withTimeout cancels the context of the request, which every store call
+// receives, once timeout expires. Zero is unlimited.
+func withTimeout(timeout time.Duration, handler fiber.Handler) fiber.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+
+	return func(ctx *fiber.Ctx) error {
+		deadline, cancel := context.WithTimeout(ctx.UserContext(), timeout)
+		defer cancel()
+
+		ctx.SetUserContext(deadline)
+
+		return handler(ctx)
+	}
+}
+
+// storeError answers a failed store call: 504 when the deadline of the
+// request expired, 503 when the shutdown of the server canceled it and 500
+// otherwise. The drivers do not always return the context error, so the
+// context is checked too. The error is kept for the log of the request.
+func storeError(ctx *fiber.Ctx, err error) error {
+	cause := ctx.UserContext().Err()
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || cause == context.DeadlineExceeded:
+		ctx.Locals(errorLocal, err)
+		return ctx.Status(fiber.StatusGatewayTimeout).JSON(ErrorResponse{Error: ErrRequestTimeout.Error()})
+	case errors.Is(err, context.Canceled) || cause == context.Canceled:
+		ctx.Locals(errorLocal, err)
+		ctx.Set(fiber.HeaderRetryAfter, "1")
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(ErrorResponse{Error: ErrRequestCanceled.Error()})
+	}
+
+	return serverError(ctx, fiber.StatusInternalServerError, err)
+}
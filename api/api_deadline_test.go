@@ -0,0 +1,166 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/person"
+)
+
+// stuckStore only returns once the context of the call is done
+type stuckStore struct {
+	persistence.Store
+}
+
+func (stuckStore) GetPerson(ctx context.Context, _ string) (*person.Person, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// GetPeople fails like lib/pq does when it cancels the query
+func (stuckStore) GetPeople(ctx context.Context, _ *persistence.GetPeopleOptions) (person.People, error) {
+	<-ctx.Done()
+	return nil, errors.New("pq: canceling statement due to user request")
+}
+
+// countingStore blocks its count until the context of the call is done
+type countingStore struct {
+	persistence.Store
+	started chan struct{}
+}
+
+func (s countingStore) GetPeopleCount(ctx context.Context) (int64, error) {
+	close(s.started)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestDeadlines(t *testing.T) {
+	server := New(stuckStore{}, Options{
+		RequestTimeout: time.Hour,
+		RouteTimeouts: map[string]time.Duration{
+			"GET /pessoas/:id": 10 * time.Millisecond,
+			"GET /pessoas":     10 * time.Millisecond,
+		},
+	})
+	server.setupApp()
+
+	get := func(path string) (*http.Response, ErrorResponse) {
+		req, err := http.NewRequest("GET", path, nil)
+		require.NoError(t, err)
+
+		resp, err := server.fiberApp.Test(req, testTimeout)
+		require.NoError(t, err)
+
+		var response ErrorResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+
+		return resp, response
+	}
+
+	start := time.Now()
+	resp, response := get("/pessoas/1")
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.Equal(t, ErrRequestTimeout.Error(), response.Error)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// the query was cancelled by the deadline, whatever the driver returns
+	resp, response = get("/pessoas?t=go")
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.Equal(t, ErrRequestTimeout.Error(), response.Error)
+}
+
+func TestShutdownCancelsRequests(t *testing.T) {
+	store := countingStore{started: make(chan struct{})}
+
+	server := New(store, Options{ShutdownTimeout: 50 * time.Millisecond})
+	server.setupApp()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.fiberApp.Listener(listener)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/contagem-pessoas")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+
+	// the request outlives the shutdown timeout, then gives up
+	<-store.started
+	require.ErrorIs(t, server.Stop(), context.DeadlineExceeded)
+
+	resp := <-responses
+	require.NotNil(t, resp)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	var response ErrorResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	require.Equal(t, ErrRequestCanceled.Error(), response.Error)
+}
+
+// slowFirstStore blocks its first GetPerson until the context of the call is
+// done, the others find the person at once
+type slowFirstStore struct {
+	persistence.Store
+	calls   atomic.Int32
+	started chan struct{}
+}
+
+func (s *slowFirstStore) GetPerson(ctx context.Context, uuid string) (*person.Person, error) {
+	if s.calls.Add(1) == 1 {
+		close(s.started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &person.Person{UUID: uuid, Name: "John Doe"}, nil
+}
+
+func TestSharedLookupOutlivesLeader(t *testing.T) {
+	store := &slowFirstStore{started: make(chan struct{})}
+
+	server := New(store, Options{
+		RouteTimeouts: map[string]time.Duration{"GET /pessoas/:id": 100 * time.Millisecond},
+	})
+	server.setupApp()
+
+	get := func() *http.Response {
+		req, err := http.NewRequest("GET", "/pessoas/1", nil)
+		require.NoError(t, err)
+
+		resp, err := server.fiberApp.Test(req, testTimeout)
+		require.NoError(t, err)
+		return resp
+	}
+
+	leader := make(chan *http.Response, 1)
+	go func() { leader <- get() }()
+
+	// the follower joins the lookup of the leader, with more time left
+	<-store.started
+	time.Sleep(50 * time.Millisecond)
+
+	resp := get()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var found map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+	require.Equal(t, "1", found["uuid"])
+
+	require.Equal(t, http.StatusGatewayTimeout, (<-leader).StatusCode)
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/person"
+)
+
+// exportFlushEvery is the number of people written between flushes of an
+// export, so the client receives them while the rest are read
+const exportFlushEvery = 100
+
+var exportHeader = []string{"uuid", "apelido", "nome", "nascimento", "stack"}
+
+// exportEncoder writes people in an export format, buffering them until
+// flushed
+type exportEncoder interface {
+	Encode(p *person.Person) error
+	Flush() error
+}
+
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e ndjsonEncoder) Encode(p *person.Person) error {
+	return e.encoder.Encode(p)
+}
+
+func (e ndjsonEncoder) Flush() error {
+	return nil
+}
+
+// csvEncoder writes one row per person, the stack as a JSON array so the
+// entries may contain any character
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (e csvEncoder) Encode(p *person.Person) error {
+	stack := ""
+	if p.Stack != nil {
+		data, err := json.Marshal(p.Stack)
+		if err != nil {
+			return err
+		}
+		stack = string(data)
+	}
+
+	return e.writer.Write([]string{p.UUID, p.Nickname, p.Name, p.Birthdate.Format("2006-01-02"), stack})
+}
+
+func (e csvEncoder) Flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func newExportEncoder(w io.Writer, format string) (exportEncoder, error) {
+	if format == "csv" {
+		encoder := csvEncoder{writer: csv.NewWriter(w)}
+		return encoder, encoder.writer.Write(exportHeader)
+	}
+
+	return ndjsonEncoder{encoder: json.NewEncoder(w)}, nil
+}
+
+// acceptsGzip reports whether the client asked for a gzip response, fiber
+// picks the first offer when there is no Accept-Encoding at all
+func acceptsGzip(ctx *fiber.Ctx) bool {
+	return ctx.Get(fiber.HeaderAcceptEncoding) != "" && ctx.AcceptsEncodings("gzip") == "gzip"
+}
+
+// exportPeople writes every person of the iterator, flushing the encoder and
+// then the output every exportFlushEvery people
+func exportPeople(encoder exportEncoder, flush func() error, people persistence.PeopleIterator) error {
+	for n := 1; people.Next(); n++ {
+		if err := encoder.Encode(people.Person()); err != nil {
+			return err
+		}
+
+		if n%exportFlushEvery == 0 {
+			if err := encoder.Flush(); err != nil {
+				return err
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := people.Err(); err != nil {
+		return err
+	}
+
+	return encoder.Flush()
+}
+
+// ExportPeople streams every person, or those matching the optional search
+// term t, as NDJSON or CSV. The people are read from the store while they
+// are sent, so a failure halfway can only cut the response short.
+func (h *PeopleHandler) ExportPeople(ctx *fiber.Ctx) error {
+	format := ctx.Query("format", "ndjson")
+
+	if format != "ndjson" && format != "csv" {
+		return ctx.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: ErrInvalidExportFormat.Error()})
+	}
+
+	people, err := h.store.IteratePeople(ctx.UserContext(), ctx.Query("t"))
+	if err != nil {
+		return storeError(ctx, err)
+	}
+
+	if format == "csv" {
+		ctx.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		ctx.Set(fiber.HeaderContentType, "application/x-ndjson")
+	}
+	ctx.Set(fiber.HeaderContentDisposition, `attachment; filename="pessoas.`+format+`"`)
+	ctx.Set(fiber.HeaderVary, fiber.HeaderAcceptEncoding)
+
+	compress := acceptsGzip(ctx)
+	if compress {
+		ctx.Set(fiber.HeaderContentEncoding, "gzip")
+	}
+
+	// the stream is written once the handler returned
+	logCtx := ctx.UserContext()
+
+	// fasthttp flushes w once the stream writer returns
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer people.Close()
+
+		var out io.Writer = w
+		flush := w.Flush
+
+		if compress {
+			zw := gzip.NewWriter(w)
+			defer zw.Close()
+
+			out = zw
+			flush = func() error {
+				if err := zw.Flush(); err != nil {
+					return err
+				}
+				return w.Flush()
+			}
+		}
+
+		encoder, err := newExportEncoder(out, format)
+		if err == nil {
+			err = exportPeople(encoder, flush, people)
+		}
+
+		if err != nil {
+			h.logger.ErrorContext(logCtx, "Exporting people failed", "format", format, "error", err)
+		}
+	})
+
+	return nil
+}
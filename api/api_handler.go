@@ -1,25 +1,47 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cursor"
 	"rinha-backend-go/person"
 
 	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/gofrs/uuid"
-	"github.com/redis/go-redis/v9"
 	"github.com/valyala/fasthttp"
+	"golang.org/x/sync/singleflight"
 )
 
 type PeopleHandler struct {
-	store persistence.Store
-	cache *redis.Client
+	store   persistence.Store
+	cursors *cursor.Codec
+
+	// defaultPageSize and maxPageSize bound the pages of GET /pessoas, zero
+	// uses persistence.DefaultPageSize and MaxPageSize
+	defaultPageSize int
+	maxPageSize     int
+
+	lookups singleflight.Group
+	// lookupTimeout bounds a shared GetPerson lookup, which does not run on
+	// the context of any of the requests waiting for it. Zero is unlimited.
+	lookupTimeout time.Duration
+
+	logger *slog.Logger
+}
+
+// personFromRequest validates the request and builds the person it describes
+func personFromRequest(request AddPersonRequest) (person.Person, error) {
+	return person.New(request.Name, request.Nickname, request.Birthdate, request.Stack)
 }
 
 func (h *PeopleHandler) AddPerson(ctx *fiber.Ctx) error {
@@ -31,65 +53,282 @@ func (h *PeopleHandler) AddPerson(ctx *fiber.Ctx) error {
 		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: err.Error()})
 	}
 
-	birthdate, err := time.Parse("2006-01-02", request.Birthdate)
+	person, err := personFromRequest(request)
 
 	if err != nil {
-		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: ErrInvalidBirthdate.Error()})
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: err.Error()})
 	}
 
-	err = request.Validate()
+	personUUID, err := uuid.NewV4()
+
+	if err != nil {
+		return serverError(ctx, fiber.StatusInternalServerError, err)
+	}
+
+	person.UUID = personUUID.String()
+
+	_, err = h.store.AddPerson(ctx.UserContext(), person)
+
+	if err != nil {
+		if err == persistence.ErrNicknameTaken {
+			return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: ErrNicknameTaken.Error()})
+		}
+
+		if err == persistence.ErrQueueFull {
+			ctx.Set(fiber.HeaderRetryAfter, "1")
+			return serverError(ctx, fiber.StatusServiceUnavailable, err)
+		}
+
+		return storeError(ctx, err)
+	}
+
+	ctx.Set(fiber.HeaderLocation, fmt.Sprintf("/pessoas/%v", person.UUID))
+
+	return ctx.Status(fiber.StatusCreated).JSON(AddPersonResponse{UUID: person.UUID})
+}
+
+// AddPeople adds every valid person of a JSON array or NDJSON body with a
+// single store call, reporting the outcome of each entry. The entries are
+// decoded as the body arrives, it is never held whole.
+func (h *PeopleHandler) AddPeople(ctx *fiber.Ctx) error {
+	batch := NewBatchReader(requestBody(ctx))
+
+	response := AddPeopleResponse{Resultados: []AddPeopleResult{}}
+	var people []person.Person
+	// added maps the people to the index of their entry
+	var added []int
+
+	for i := 0; ; i++ {
+		entry, err := batch.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			// the rest of the body is left unread on the connection
+			ctx.Context().SetConnectionClose()
+			return ctx.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: err.Error()})
+		}
+
+		response.Resultados = append(response.Resultados, AddPeopleResult{Index: i})
+
+		var request AddPersonRequest
+		if err := json.Unmarshal(entry, &request); err != nil {
+			response.Resultados[i].Error = ErrInvalidPerson.Error()
+			continue
+		}
+
+		p, err := personFromRequest(request)
+		if err != nil {
+			response.Resultados[i].Error = err.Error()
+			continue
+		}
+
+		personUUID, err := uuid.NewV4()
+		if err != nil {
+			return serverError(ctx, fiber.StatusInternalServerError, err)
+		}
+		p.UUID = personUUID.String()
+
+		people = append(people, p)
+		added = append(added, i)
+	}
+
+	ids, err := h.store.BatchAddPeople(ctx.UserContext(), people)
+
+	if err != nil {
+		return storeError(ctx, err)
+	}
+
+	for j, i := range added {
+		if ids[j] == 0 {
+			response.Resultados[i].Error = ErrNicknameTaken.Error()
+			continue
+		}
+
+		response.Resultados[i].UUID = people[j].UUID
+		response.Added++
+	}
+
+	response.Rejected = len(response.Resultados) - response.Added
+
+	return ctx.JSON(response)
+}
+
+func (h *PeopleHandler) UpdatePerson(ctx *fiber.Ctx) error {
+	var request AddPersonRequest
+
+	err := ctx.BodyParser(&request)
 
 	if err != nil {
 		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: err.Error()})
 	}
 
-	personUUID, err := uuid.NewV4()
+	person, err := personFromRequest(request)
+
+	if err != nil {
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: err.Error()})
+	}
+
+	person.UUID = ctx.Params("id")
+
+	err = h.store.UpdatePerson(ctx.UserContext(), person)
 
 	if err != nil {
-		return ctx.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		if err == persistence.ErrPersonNotFound {
+			return ctx.Status(fiber.StatusNotFound).JSON(ErrorResponse{Error: err.Error()})
+		}
+
+		if err == persistence.ErrNicknameTaken {
+			return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: ErrNicknameTaken.Error()})
+		}
+
+		return storeError(ctx, err)
 	}
 
-	person := person.Person{
-		Name:      request.Name,
-		UUID:      personUUID.String(),
-		Nickname:  request.Nickname,
-		Birthdate: birthdate,
-		Stack:     request.Stack,
+	return ctx.JSON(&person)
+}
+
+func (h *PeopleHandler) PatchPerson(ctx *fiber.Ctx) error {
+	var document map[string]json.RawMessage
+
+	err := json.Unmarshal(ctx.Body(), &document)
+
+	if err != nil || document == nil {
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: ErrInvalidPatch.Error()})
 	}
 
-	_, err = h.store.AddPerson(ctx.Context(), person)
+	personID := ctx.Params("id")
+
+	current, err := h.store.GetPerson(ctx.UserContext(), personID)
 
 	if err != nil {
-		return ctx.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		if err == persistence.ErrPersonNotFound {
+			return ctx.Status(fiber.StatusNotFound).JSON(ErrorResponse{Error: err.Error()})
+		}
+
+		return storeError(ctx, err)
 	}
 
-	personJSONCache, err := json.Marshal(person)
+	request := AddPersonRequest{
+		Name:      current.Name,
+		Nickname:  current.Nickname,
+		Birthdate: current.Birthdate.Format("2006-01-02"),
+		Stack:     current.Stack,
+	}
+
+	err = request.ApplyMergePatch(document)
 
 	if err != nil {
-		return ctx.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: err.Error()})
 	}
 
-	err = h.cache.Set(ctx.Context(), person.UUID, personJSONCache, 0).Err()
+	merged, err := personFromRequest(request)
 
 	if err != nil {
-		return ctx.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: err.Error()})
 	}
 
-	ctx.Set(fiber.HeaderLocation, fmt.Sprintf("/pessoas/%v", person.UUID))
+	patch := persistence.PersonPatch{}
 
-	return ctx.Status(fiber.StatusCreated).JSON(AddPersonResponse{UUID: person.UUID})
+	if _, ok := document["nome"]; ok {
+		patch.Name = &merged.Name
+	}
+
+	if _, ok := document["apelido"]; ok {
+		patch.Nickname = &merged.Nickname
+	}
+
+	if _, ok := document["nascimento"]; ok {
+		patch.Birthdate = &merged.Birthdate
+	}
+
+	if _, ok := document["stack"]; ok {
+		patch.Stack = &merged.Stack
+	}
+
+	updated, err := h.store.PatchPerson(ctx.UserContext(), personID, patch)
+
+	if err != nil {
+		if err == persistence.ErrPersonNotFound {
+			return ctx.Status(fiber.StatusNotFound).JSON(ErrorResponse{Error: err.Error()})
+		}
+
+		if err == persistence.ErrNicknameTaken {
+			return ctx.Status(fiber.StatusUnprocessableEntity).JSON(ErrorResponse{Error: ErrNicknameTaken.Error()})
+		}
+
+		return storeError(ctx, err)
+	}
+
+	return ctx.JSON(updated)
 }
 
-// generatePaginationToken generates a pagination token based on the last person in the slice
-// The token is a string in the format: <person_id>-<unix_timestamp>
-func generatePaginationToken(people person.People) string {
-	if len(people) == 0 {
-		return ""
+func (h *PeopleHandler) DeletePerson(ctx *fiber.Ctx) error {
+	personID := ctx.Params("id")
+
+	err := h.store.DeletePerson(ctx.UserContext(), personID)
+
+	if err != nil {
+		if err == persistence.ErrPersonNotFound {
+			return ctx.Status(fiber.StatusNotFound).JSON(ErrorResponse{Error: err.Error()})
+		}
+
+		return storeError(ctx, err)
+	}
+
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// Bounds of the tamanho query param of GET /pessoas, sizes out of
+// bounds are clamped. MaxPageSize is the default upper bound.
+const (
+	minPageSize = 1
+	MaxPageSize = 50
+)
+
+// pageLink returns the URL of the current search with pagina set to the
+// token of c
+func (h *PeopleHandler) pageLink(ctx *fiber.Ctx, c cursor.Cursor, query string) *string {
+	var link fasthttp.URI
+	ctx.Request().URI().CopyTo(&link)
+	link.QueryArgs().Set("pagina", h.cursors.Encode(c, query))
+
+	url := link.String()
+	return &url
+}
+
+// pageSize reads the tamanho query param, clamped to the server bounds
+func (h *PeopleHandler) pageSize(ctx *fiber.Ctx) (int, error) {
+	tamanho := ctx.Query("tamanho")
+
+	if tamanho == "" {
+		if h.defaultPageSize > 0 {
+			return h.defaultPageSize, nil
+		}
+		return persistence.DefaultPageSize, nil
+	}
+
+	size, err := strconv.Atoi(tamanho)
+
+	if err != nil {
+		return 0, ErrInvalidPageSize
+	}
+
+	maxSize := MaxPageSize
+	if h.maxPageSize > 0 {
+		maxSize = h.maxPageSize
 	}
 
-	lastPerson := people[len(people)-1]
+	if size < minPageSize {
+		return minPageSize, nil
+	}
+
+	if size > maxSize {
+		return maxSize, nil
+	}
 
-	return fmt.Sprintf("%v-%v", lastPerson.ID, lastPerson.CreatedAt.Unix())
+	return size, nil
 }
 
 func (h *PeopleHandler) GetPeople(ctx *fiber.Ctx) error {
@@ -100,95 +339,149 @@ func (h *PeopleHandler) GetPeople(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusBadRequest).SendString("O parâmetro 't' é obrigatório")
 	}
 
-	options := &persistence.GetPeopleOptions{
-		PaginationToken: ctx.Query("pagina"),
-		SearchQuery:     ctx.Query("t"),
-	}
-
-	people, err := h.store.GetPeople(ctx.Context(), options)
+	size, err := h.pageSize(ctx)
 
 	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: err.Error()})
+	}
 
-		return ctx.Status(http.StatusInternalServerError).SendString(err.Error())
+	// fetch one extra person to find out whether there is a next page
+	options := &persistence.GetPeopleOptions{
+		SearchQuery: t,
+		PageSize:    size + 1,
 	}
 
-	response := GetPeopleResponse{Resultados: people}
+	page := 1
+	backward := false
 
-	if ctx.Query("pagina") != "" {
-		var prevUrl = fasthttp.URI{}
-		// ctx.Request().URI().CopyTo(&prevUrl)
-		prevUrl.SetHost(string(ctx.Request().URI().Host()))
-		prevUrl.SetScheme(string(ctx.Request().URI().Scheme()))
-		prevUrl.SetPath("/pessoas")
-		queryValues := prevUrl.QueryArgs()
+	if token := ctx.Query("pagina"); token != "" {
+		c, err := h.cursors.Decode(token, t)
 
-		paginationStack := ctx.Query("paginationStack")
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: ErrInvalidPaginationToken.Error()})
+		}
 
-		if paginationStack != "" {
-			previousPaginationToken := strings.Split(paginationStack, ",")
-			queryValues.Set("pagina", previousPaginationToken[len(previousPaginationToken)-1])
-			queryValues.Set("paginationStack", strings.Join(previousPaginationToken[:len(previousPaginationToken)-1], ","))
-			if len(previousPaginationToken)-1 == 0 {
-				queryValues.Del("paginationStack")
-			}
+		if c.Direction == cursor.Backward {
+			options.Before = &c
+			backward = true
+		} else {
+			options.After = &c
 		}
+		page = c.Page
+	}
+
+	people, err := h.store.GetPeople(ctx.UserContext(), options)
 
-		anterior := prevUrl.String()
-		response.Anterior = &anterior
+	if err != nil {
+		return storeError(ctx, err)
 	}
 
-	if len(people) == 5 {
-		var nextUrl = fasthttp.URI{}
-		ctx.Request().URI().CopyTo(&nextUrl)
-		queryValues := nextUrl.QueryArgs()
+	// the extra person is past the end of the page in the direction it was
+	// fetched, so it tells whether there is a page further that way
+	hasPrevious, hasNext := page > 1, len(people) > size
 
-		if ctx.Query("pagina") != "" {
-			queryValues.Set("paginationStack", ctx.Query("paginationStack")+","+ctx.Query("pagina"))
+	if backward {
+		// a backward page was reached from the page after it
+		hasPrevious, hasNext = len(people) > size, true
+
+		if len(people) > size {
+			people = people[len(people)-size:]
+		} else {
+			page = 1
 		}
+	} else if len(people) > size {
+		people = people[:size]
+	}
 
-		queryValues.Set("pagina", generatePaginationToken(people))
-		proxima := nextUrl.String()
-		response.Proxima = &proxima
+	response := GetPeopleResponse{Qtd: len(people), Pagina: page, Resultados: people}
+
+	if len(people) == 0 {
+		return ctx.JSON(response)
+	}
+
+	if hasPrevious {
+		previous := cursor.FromPerson(people[0])
+		previous.Direction = cursor.Backward
+		previous.Page = max(page-1, 1)
+		response.Anterior = h.pageLink(ctx, previous, t)
+	}
+
+	if hasNext {
+		next := cursor.FromPerson(people[len(people)-1])
+		next.Page = page + 1
+		response.Proxima = h.pageLink(ctx, next, t)
 	}
 
 	return ctx.JSON(response)
 }
 
-func (h *PeopleHandler) GetPerson(ctx *fiber.Ctx) error {
-	personID := ctx.Params("id")
+// timeLeft reports whether ctx is neither done nor past its deadline, which
+// it may be before its timer canceled it
+func timeLeft(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Now().Before(deadline)
+}
 
-	cachedPerson, err := h.cache.Get(ctx.Context(), personID).Result()
+// lookupPerson shares a single store lookup between the concurrent requests
+// for the same person. The lookup is detached from the request that started
+// it, so its deadline or cancellation does not fail the others, and each
+// request stops waiting when its own context is done. A lookup that ran out
+// of time is started again for a request that still has time left.
+func (h *PeopleHandler) lookupPerson(ctx context.Context, personID string) (*person.Person, error) {
+	for {
+		lookup := h.lookups.DoChan(personID, func() (interface{}, error) {
+			shared := context.WithoutCancel(ctx)
+			if h.lookupTimeout > 0 {
+				var cancel context.CancelFunc
+				shared, cancel = context.WithTimeout(shared, h.lookupTimeout)
+				defer cancel()
+			}
 
-	if err != nil {
+			return h.store.GetPerson(shared, personID)
+		})
 
-		return ctx.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		select {
+		case result := <-lookup:
+			if errors.Is(result.Err, context.DeadlineExceeded) && timeLeft(ctx) {
+				continue
+			}
+			if result.Err != nil {
+				return nil, result.Err
+			}
+			return result.Val.(*person.Person), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+}
 
-	if cachedPerson != "" {
-		ctx.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
-		_, err = ctx.Write([]byte(cachedPerson))
-		return err
-	}
+func (h *PeopleHandler) GetPerson(ctx *fiber.Ctx) error {
+	// the key outlives this request while others wait on the lookup, so it
+	// must not point into the request buffer
+	personID := utils.CopyString(ctx.Params("id"))
 
-	person, err := h.store.GetPerson(ctx.Context(), personID)
+	found, err := h.lookupPerson(ctx.UserContext(), personID)
 
 	if err != nil {
 		if err == persistence.ErrPersonNotFound {
 			return ctx.Status(fiber.StatusNotFound).JSON(ErrorResponse{Error: err.Error()})
 		}
 
-		return ctx.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return storeError(ctx, err)
 	}
 
-	return ctx.JSON(person)
+	return ctx.JSON(found)
 }
 
 func (h *PeopleHandler) GetPeopleCount(ctx *fiber.Ctx) error {
-	count, err := h.store.GetPeopleCount(ctx.Context())
+	count, err := h.store.GetPeopleCount(ctx.UserContext())
 
 	if err != nil {
-
-		return ctx.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Error: err.Error()})
+		return storeError(ctx, err)
 	}
 
 	_, err = ctx.Write([]byte(strconv.FormatInt(count, 10)))
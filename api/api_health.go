@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultCheckTimeout bounds a readiness check that sets no timeout
+const DefaultCheckTimeout = time.Second
+
+// Check probes a dependency the server needs to serve requests
+type Check struct {
+	Name string
+	// Timeout bounds the probe, DefaultCheckTimeout when zero
+	Timeout time.Duration
+	Probe   func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+	statusStopping    = "stopping"
+)
+
+// run probes the dependency, failing when the timeout expires
+func (c Check) run(ctx context.Context) CheckResult {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	// the probe may ignore the context, it is left running past the timeout
+	done := make(chan error, 1)
+	go func() { done <- c.Probe(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := CheckResult{Status: statusOK, Duration: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = statusUnavailable
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// Healthz reports the process is alive, whatever the state of its dependencies
+func (s *Server) Healthz(ctx *fiber.Ctx) error {
+	return ctx.JSON(ReadinessResponse{Status: statusOK})
+}
+
+// Readyz runs every check at once, answering 503 when any fails or the
+// server is stopping so the load balancer stops sending requests
+func (s *Server) Readyz(ctx *fiber.Ctx) error {
+	if s.stopping.Load() {
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(ReadinessResponse{Status: statusStopping})
+	}
+
+	// a probe left running past its timeout must not hold the fasthttp
+	// context, it is recycled for the next request once the handler returns
+	probeCtx := ctx.UserContext()
+
+	response := ReadinessResponse{Status: statusOK, Checks: make(map[string]CheckResult, len(s.checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, check := range s.checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+
+			result := check.run(probeCtx)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			response.Checks[check.Name] = result
+			if result.Status != statusOK {
+				response.Status = statusUnavailable
+			}
+		}(check)
+	}
+
+	wg.Wait()
+
+	if response.Status != statusOK {
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(response)
+	}
+
+	return ctx.JSON(response)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/persistence/memory"
+)
+
+func readiness(t *testing.T, app *fiber.App, path string) (int, ReadinessResponse) {
+	req, err := http.NewRequest("GET", path, nil)
+	require.NoError(t, err)
+
+	resp, err := app.Test(req, testTimeout)
+	require.NoError(t, err)
+
+	var response ReadinessResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+
+	return resp.StatusCode, response
+}
+
+func TestReadiness(t *testing.T) {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+
+	server := New(store, Options{})
+
+	app := fiber.New()
+	app.Get("/healthz", server.Healthz)
+	app.Get("/readyz", server.Readyz)
+
+	status, response := readiness(t, app, "/readyz")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "ok", response.Status)
+	require.Equal(t, "ok", response.Checks["store"].Status)
+
+	server.AddCheck(Check{Name: "redis", Probe: func(context.Context) error { return errors.New("connection refused") }})
+	// a probe ignoring its context still fails on time
+	server.AddCheck(Check{Name: "slow", Timeout: 10 * time.Millisecond, Probe: func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}})
+
+	status, response = readiness(t, app, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "unavailable", response.Status)
+	require.Equal(t, "ok", response.Checks["store"].Status)
+	require.Equal(t, CheckResult{Status: "unavailable", Duration: response.Checks["redis"].Duration, Error: "connection refused"}, response.Checks["redis"])
+	require.Equal(t, context.DeadlineExceeded.Error(), response.Checks["slow"].Error)
+	require.Less(t, response.Checks["slow"].Duration, float64(500))
+
+	server.stopping.Store(true)
+
+	status, response = readiness(t, app, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "stopping", response.Status)
+
+	// the process is alive until it exits
+	status, response = readiness(t, app, "/healthz")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "ok", response.Status)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"rinha-backend-go/logging"
+)
+
+// maxRequestIDLength bounds the X-Request-ID accepted from the callers
+const maxRequestIDLength = 128
+
+// errorLocal keeps the error behind a failed response for the access log
+const errorLocal = "error"
+
+// serverError answers status with the message of err, keeping err for the
+// log of the failed request
+func serverError(ctx *fiber.Ctx, status int, err error) error {
+	ctx.Locals(errorLocal, err)
+	return ctx.Status(status).JSON(ErrorResponse{Error: err.Error()})
+}
+
+// validRequestID reports whether id can be logged and echoed as is: printable
+// ASCII of a bounded length
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestID takes the X-Request-ID of the caller, or generates one, and sets
+// it on the response and on the request context so every record logged for
+// the request carries it
+func requestID(ctx *fiber.Ctx) error {
+	id := ctx.Get(fiber.HeaderXRequestID)
+
+	if !validRequestID(id) {
+		generated, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		id = generated.String()
+	}
+
+	ctx.Set(fiber.HeaderXRequestID, id)
+	ctx.SetUserContext(logging.WithRequestID(ctx.UserContext(), id))
+
+	return ctx.Next()
+}
+
+// accessLog logs the failed requests with their error, and a sample of the
+// others
+type accessLog struct {
+	logger *slog.Logger
+	ratio  float64
+}
+
+func (l *accessLog) middleware(ctx *fiber.Ctx) error {
+	start := time.Now()
+
+	err := ctx.Next()
+
+	route, status := served(ctx, err)
+
+	failed := status >= fiber.StatusInternalServerError
+	if !failed && (l.ratio <= 0 || rand.Float64() >= l.ratio) {
+		return err
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", ctx.Method()),
+		slog.String("route", route),
+		slog.String("path", ctx.Path()),
+		slog.Int("status", status),
+		slog.Duration("duration", time.Since(start)),
+	}
+
+	if !failed {
+		l.logger.LogAttrs(ctx.UserContext(), slog.LevelInfo, "Request served", attrs...)
+		return err
+	}
+
+	cause := err
+	if recorded, ok := ctx.Locals(errorLocal).(error); ok {
+		cause = recorded
+	}
+	if cause != nil {
+		attrs = append(attrs, slog.String("error", cause.Error()))
+	}
+
+	l.logger.LogAttrs(ctx.UserContext(), slog.LevelError, "Request failed", attrs...)
+
+	return err
+}
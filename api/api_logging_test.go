@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/logging"
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/memory"
+)
+
+// brokenCountStore fails every count, like a store that lost its database
+type brokenCountStore struct {
+	persistence.Store
+}
+
+func (brokenCountStore) GetPeopleCount(context.Context) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+// records decodes the JSON records logged to out
+func records(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var logged []map[string]interface{}
+
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		logged = append(logged, record)
+	}
+
+	return logged
+}
+
+func TestRequestLogging(t *testing.T) {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	logger, err := logging.New(&out, "json", slog.LevelInfo)
+	require.NoError(t, err)
+
+	server := New(brokenCountStore{store}, Options{Logger: logger, AccessLogSampleRatio: 1})
+	server.setupApp()
+
+	get := func(path string, id string) *http.Response {
+		req, err := http.NewRequest("GET", path, nil)
+		require.NoError(t, err)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+
+		resp, err := server.fiberApp.Test(req, testTimeout)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the ID of the caller is kept
+	resp := get("/pessoas/unknown", "abc-123")
+	require.Equal(t, "abc-123", resp.Header.Get("X-Request-ID"))
+
+	logged := records(t, &out)
+	require.Len(t, logged, 1)
+	require.Equal(t, "Request served", logged[0]["msg"])
+	require.Equal(t, "abc-123", logged[0][logging.RequestIDKey])
+	require.Equal(t, "/pessoas/:id", logged[0]["route"])
+	require.Equal(t, float64(http.StatusNotFound), logged[0]["status"])
+
+	// a missing or unusable ID is replaced
+	resp = get("/pessoas/unknown", "")
+	require.Len(t, resp.Header.Get("X-Request-ID"), 36)
+
+	resp = get("/pessoas/unknown", strings.Repeat("a", maxRequestIDLength+1))
+	require.Len(t, resp.Header.Get("X-Request-ID"), 36)
+
+	// failures are always logged, with the error of the store
+	out.Reset()
+	server.options.AccessLogSampleRatio = 0
+	server.setupApp()
+
+	resp = get("/contagem-pessoas", "def-456")
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, "def-456", resp.Header.Get("X-Request-ID"))
+
+	get("/pessoas/unknown", "")
+
+	logged = records(t, &out)
+	require.Len(t, logged, 1)
+	require.Equal(t, "Request failed", logged[0]["msg"])
+	require.Equal(t, "ERROR", logged[0]["level"])
+	require.Equal(t, "def-456", logged[0][logging.RequestIDKey])
+	require.Equal(t, "connection refused", logged[0]["error"])
+}
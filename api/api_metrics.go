@@ -0,0 +1,79 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute labels the requests no route matched, so unknown paths do
+// not create a series each
+const unmatchedRoute = "unmatched"
+
+// httpMetrics counts the requests and their latency by route
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newHTTPMetrics(registerer prometheus.Registerer) *httpMetrics {
+	m := &httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of the HTTP requests by route and method.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"route", "method"}),
+	}
+
+	registerer.MustRegister(m.requests, m.duration)
+
+	return m
+}
+
+// served returns the route that served the request and its status, once
+// the next handlers returned err
+func served(ctx *fiber.Ctx, err error) (string, int) {
+	// the error handler writes the status after the middlewares return
+	status := ctx.Response().StatusCode()
+	if e, ok := err.(*fiber.Error); ok {
+		status = e.Code
+	} else if err != nil {
+		status = fiber.StatusInternalServerError
+	}
+
+	route := ctx.Route().Path
+	if status == fiber.StatusNotFound && route == "/" {
+		route = unmatchedRoute
+	}
+
+	return route, status
+}
+
+// middleware measures the requests served by the next handlers. A streamed
+// response is measured until its handler returns, not until it is sent.
+func (m *httpMetrics) middleware(ctx *fiber.Ctx) error {
+	start := time.Now()
+
+	err := ctx.Next()
+
+	route, status := served(ctx, err)
+	method := ctx.Method()
+
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.duration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler(gatherer prometheus.Gatherer) fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/persistence/memory"
+)
+
+func TestMetrics(t *testing.T) {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+
+	server := New(store, Options{Metrics: prometheus.NewRegistry()})
+	server.setupApp()
+
+	get := func(path string) (int, string) {
+		req, err := http.NewRequest("GET", path, nil)
+		require.NoError(t, err)
+
+		resp, err := server.fiberApp.Test(req, testTimeout)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := get("/pessoas/unknown")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = get("/pessoas?t=go")
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = get("/nowhere")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, body := get("/metrics")
+	require.Equal(t, http.StatusOK, status)
+
+	lines := strings.Split(body, "\n")
+
+	// requests are labelled by their route, not their path
+	require.Contains(t, lines, `http_requests_total{method="GET",route="/pessoas/:id",status="404"} 1`)
+	require.Contains(t, lines, `http_requests_total{method="GET",route="/pessoas",status="200"} 1`)
+	require.Contains(t, lines, `http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	require.Contains(t, lines, `http_request_duration_seconds_count{method="GET",route="/pessoas/:id"} 1`)
+}
@@ -1,8 +1,14 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
-	"strings"
+	"io"
+
+	"github.com/goccy/go-json"
+
+	"rinha-backend-go/person"
 )
 
 type AddPersonRequest struct {
@@ -13,35 +19,159 @@ type AddPersonRequest struct {
 }
 
 var (
-	ErrInvalidName      = errors.New("Nome inválido")
-	ErrInvalidNickname  = errors.New("Apelido inválido")
-	ErrInvalidBirthdate = errors.New("Data de nascimento inválida")
-	ErrInvalidStack     = errors.New("Stack inválida")
+	// the validation errors belong to person, shared with rinhactl
+	ErrInvalidName      = person.ErrInvalidName
+	ErrInvalidNickname  = person.ErrInvalidNickname
+	ErrInvalidBirthdate = person.ErrInvalidBirthdate
+	ErrInvalidStack     = person.ErrInvalidStack
+	ErrInvalidPerson    = person.ErrInvalidPerson
+
+	ErrNicknameTaken = errors.New("Apelido já está em uso")
+	ErrInvalidPatch  = errors.New("Patch inválido")
+	ErrInvalidBatch  = errors.New("Lote inválido")
+
+	ErrInvalidPaginationToken = errors.New("Token de paginação inválido")
+	ErrInvalidPageSize        = errors.New("Tamanho de página inválido")
+	ErrInvalidExportFormat    = errors.New("Formato de exportação inválido")
 )
 
 func (r *AddPersonRequest) Validate() error {
-	if r.Name == "" || len(r.Name) > 32 {
-		return ErrInvalidName
+	return person.Validate(r.Name, r.Nickname, r.Birthdate, r.Stack)
+}
+
+// ApplyMergePatch applies a JSON Merge Patch (RFC 7396) document to the request.
+// A null member removes the field, leaving it with its zero value.
+func (r *AddPersonRequest) ApplyMergePatch(document map[string]json.RawMessage) error {
+	fields := map[string]interface{}{
+		"nome":       &r.Name,
+		"apelido":    &r.Nickname,
+		"nascimento": &r.Birthdate,
+		"stack":      &r.Stack,
 	}
 
-	// nickname must contain only letters and spaces
-	if r.Nickname == "" || len(r.Nickname) > 75 || strings.ContainsAny(r.Nickname, "0123456789!@#$%¨&*()_+{}^~:<>?/|\\") {
-		return ErrInvalidNickname
+	for key, value := range document {
+		field, ok := fields[key]
+		if !ok {
+			continue
+		}
+
+		if string(value) == "null" {
+			switch f := field.(type) {
+			case *string:
+				*f = ""
+			case *[]string:
+				*f = nil
+			}
+			continue
+		}
+
+		if err := json.Unmarshal(value, field); err != nil {
+			return ErrInvalidPatch
+		}
 	}
 
-	// birthdate must be in the format YYYY-MM-DD
-	if r.Birthdate == "" {
-		return ErrInvalidBirthdate
+	return nil
+}
+
+// maxBatchEntrySize bounds an NDJSON entry of POST /pessoas/lote
+const maxBatchEntrySize = 64 << 10
+
+// BatchReader reads the entries of the body of POST /pessoas/lote as they
+// arrive. The body is either a JSON array or NDJSON, one entry per line,
+// blank lines are skipped. The entries are not decoded, so a malformed one
+// only rejects itself.
+type BatchReader struct {
+	body  *bufio.Reader
+	array *json.Decoder
+	// started is set once the format of the body is known
+	started bool
+}
+
+func NewBatchReader(body io.Reader) *BatchReader {
+	return &BatchReader{body: bufio.NewReaderSize(body, maxBatchEntrySize)}
+}
+
+// Next returns the next entry, io.EOF after the last one and ErrInvalidBatch
+// when the body is malformed or cannot be read
+func (b *BatchReader) Next() (json.RawMessage, error) {
+	if !b.started {
+		b.started = true
+
+		if err := b.start(); err != nil {
+			return nil, err
+		}
 	}
 
-	if r.Stack != nil {
-		for _, stack := range r.Stack {
-			if len(stack) > 10 {
-				return ErrInvalidStack
+	if b.array != nil {
+		return b.nextElement()
+	}
+
+	return b.nextLine()
+}
+
+// start picks the format by the first byte of the body
+func (b *BatchReader) start() error {
+	for {
+		c, err := b.body.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ErrInvalidBatch
+		}
+
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+
+		_ = b.body.UnreadByte()
+
+		if c == '[' {
+			b.array = json.NewDecoder(b.body)
+			if _, err := b.array.Token(); err != nil {
+				return ErrInvalidBatch
 			}
 		}
+
+		return nil
 	}
+}
 
-	return nil
+func (b *BatchReader) nextElement() (json.RawMessage, error) {
+	if b.array.More() {
+		var entry json.RawMessage
+		if err := b.array.Decode(&entry); err != nil {
+			return nil, ErrInvalidBatch
+		}
+		return entry, nil
+	}
 
+	// the closing bracket, then nothing but the end of the body
+	if token, err := b.array.Token(); err != nil || token != json.Delim(']') {
+		return nil, ErrInvalidBatch
+	}
+
+	if _, err := b.array.Token(); err != io.EOF {
+		return nil, ErrInvalidBatch
+	}
+
+	return nil, io.EOF
+}
+
+func (b *BatchReader) nextLine() (json.RawMessage, error) {
+	for {
+		line, err := b.body.ReadSlice('\n')
+		if err != nil && err != io.EOF {
+			return nil, ErrInvalidBatch
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			// the line is overwritten by the next read
+			return append(json.RawMessage(nil), line...), nil
+		}
+
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
 }
@@ -17,3 +17,17 @@ type GetPeopleResponse struct {
 type AddPersonResponse struct {
 	UUID string `json:"uuid"`
 }
+
+// AddPeopleResult is the outcome of one entry of POST /pessoas/lote, it has
+// the UUID of the person when added and the error otherwise
+type AddPeopleResult struct {
+	Index int    `json:"indice"`
+	UUID  string `json:"uuid,omitempty"`
+	Error string `json:"erro,omitempty"`
+}
+
+type AddPeopleResponse struct {
+	Added      int               `json:"inseridos"`
+	Rejected   int               `json:"rejeitados"`
+	Resultados []AddPeopleResult `json:"resultados"`
+}
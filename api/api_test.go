@@ -2,25 +2,56 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"rinha-backend-go/persistence/sqlite"
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cursor"
+	"rinha-backend-go/persistence/memory"
+	"rinha-backend-go/person"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/suite"
 )
 
+// testTimeout is the app.Test timeout in milliseconds
+const testTimeout = 1000
+
 type APITestSuite struct {
 	suite.Suite
 	app *fiber.App
+
+	nicknames int
+}
+
+// nickname returns a nickname not used by any other test, nicknames
+// may only contain letters so the sequence is spelled out in base 26
+func (s *APITestSuite) nickname() string {
+	s.nicknames++
+
+	nickname := "nick"
+	for n := s.nicknames; n > 0; n /= 26 {
+		nickname += string(rune('a' + n%26))
+	}
+
+	return nickname
 }
 
 func (s *APITestSuite) SetupSuite() {
-	store, err := sqlite.NewSQLiteStore()
+	store, err := memory.NewMemoryStore("")
 	s.Require().NoError(err)
 
 	s.app = fiber.New(
@@ -30,18 +61,23 @@ func (s *APITestSuite) SetupSuite() {
 		},
 	)
 
-	handler := PeopleHandler{store: store}
+	handler := PeopleHandler{store: store, cursors: cursor.NewCodec([]byte("test")), logger: slog.Default()}
 
 	s.app.Get("/pessoas", handler.GetPeople)
+	s.app.Get("/pessoas/export", handler.ExportPeople)
 	s.app.Post("/pessoas", handler.AddPerson)
+	s.app.Post("/pessoas/lote", handler.AddPeople)
 	s.app.Get("/pessoas/:id", handler.GetPerson)
+	s.app.Put("/pessoas/:id", handler.UpdatePerson)
+	s.app.Patch("/pessoas/:id", handler.PatchPerson)
+	s.app.Delete("/pessoas/:id", handler.DeletePerson)
 
 }
 
 func (s *APITestSuite) TestAddPerson() {
 	request := AddPersonRequest{
 		Name:      "John Doe",
-		Nickname:  "johndoe",
+		Nickname:  s.nickname(),
 		Birthdate: "1990-01-01",
 		Stack:     []string{"Go", "Python"},
 	}
@@ -53,7 +89,7 @@ func (s *APITestSuite) TestAddPerson() {
 
 	s.Require().NoError(err)
 
-	resp, err := s.app.Test(req, 3)
+	resp, err := s.app.Test(req, testTimeout)
 
 	s.Require().NoError(err)
 
@@ -80,7 +116,7 @@ func (s *APITestSuite) TestAddPersonInvalidBirthdate() {
 		s.Require().NoError(err)
 	}
 
-	resp, err := s.app.Test(req, 2)
+	resp, err := s.app.Test(req, testTimeout)
 
 	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
 }
@@ -102,7 +138,7 @@ func (s *APITestSuite) TestAddPersonInvalidStack() {
 		s.Require().NoError(err)
 	}
 
-	resp, err := s.app.Test(req, 2)
+	resp, err := s.app.Test(req, testTimeout)
 
 	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
 }
@@ -110,7 +146,7 @@ func (s *APITestSuite) TestAddPersonInvalidStack() {
 func (s *APITestSuite) TestGetPerson() {
 	request := AddPersonRequest{
 		Name:      "John Doe",
-		Nickname:  "johndoe",
+		Nickname:  s.nickname(),
 		Birthdate: "1990-01-01",
 		Stack:     []string{"Go", "Python"},
 	}
@@ -124,7 +160,7 @@ func (s *APITestSuite) TestGetPerson() {
 		s.Require().NoError(err)
 	}
 
-	resp, err := s.app.Test(req, 2)
+	resp, err := s.app.Test(req, testTimeout)
 
 	s.Equal(http.StatusCreated, resp.StatusCode)
 
@@ -134,9 +170,578 @@ func (s *APITestSuite) TestGetPerson() {
 		s.Require().NoError(err)
 	}
 
-	resp, err = s.app.Test(req, 2)
+	resp, err = s.app.Test(req, testTimeout)
+
+	s.Equal(http.StatusOK, resp.StatusCode)
+}
+
+// createPerson adds a person through the API and returns its location
+func (s *APITestSuite) createPerson(request AddPersonRequest) string {
+	jsonRequest, _ := json.Marshal(request)
+
+	req, err := http.NewRequest("POST", "/pessoas", bytes.NewReader(jsonRequest))
+	s.Require().NoError(err)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := s.app.Test(req, testTimeout)
+	s.Require().NoError(err)
+	s.Require().Equal(http.StatusCreated, resp.StatusCode)
+
+	return resp.Header.Get("Location")
+}
+
+func (s *APITestSuite) getPerson(location string) (int, map[string]interface{}) {
+	req, err := http.NewRequest("GET", location, nil)
+	s.Require().NoError(err)
+
+	resp, err := s.app.Test(req, testTimeout)
+	s.Require().NoError(err)
+
+	var body map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+
+	return resp.StatusCode, body
+}
+
+func (s *APITestSuite) send(method string, location string, body string) *http.Response {
+	req, err := http.NewRequest(method, location, bytes.NewReader([]byte(body)))
+	s.Require().NoError(err)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := s.app.Test(req, testTimeout)
+	s.Require().NoError(err)
+
+	return resp
+}
+
+func (s *APITestSuite) TestUpdatePerson() {
+	location := s.createPerson(AddPersonRequest{
+		Name:      "John Doe",
+		Nickname:  s.nickname(),
+		Birthdate: "1990-01-01",
+		Stack:     []string{"Go", "Python"},
+	})
+
+	nickname := s.nickname()
+
+	resp := s.send("PUT", location, fmt.Sprintf(`{"nome":"Jane Doe","apelido":"%v","nascimento":"1991-02-03","stack":null}`, nickname))
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	status, body := s.getPerson(location)
+	s.Equal(http.StatusOK, status)
+	s.Equal("Jane Doe", body["name"])
+	s.Equal(nickname, body["apelido"])
+	s.Equal("1991-02-03", body["nascimento"])
+	s.Nil(body["stack"])
+}
+
+func (s *APITestSuite) TestUpdatePersonInvalid() {
+	location := s.createPerson(AddPersonRequest{
+		Name:      "John Doe",
+		Nickname:  s.nickname(),
+		Birthdate: "1990-01-01",
+	})
+
+	resp := s.send("PUT", location, `{"nome":"Jane Doe","apelido":"janedoe","nascimento":"1991-02-03 00:00"}`)
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = s.send("PUT", location, `{"nome":"","apelido":"janedoe","nascimento":"1991-02-03"}`)
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func (s *APITestSuite) TestUpdatePersonNotFound() {
+	resp := s.send("PUT", "/pessoas/2c1f1b43-5a3c-4d4a-9f0e-1a2b3c4d5e6f", `{"nome":"Jane Doe","apelido":"janedoe","nascimento":"1991-02-03"}`)
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *APITestSuite) TestPatchPerson() {
+	location := s.createPerson(AddPersonRequest{
+		Name:      "John Doe",
+		Nickname:  s.nickname(),
+		Birthdate: "1990-01-01",
+		Stack:     []string{"Go", "Python"},
+	})
+
+	nickname := s.nickname()
+
+	resp := s.send("PATCH", location, fmt.Sprintf(`{"apelido":"%v","stack":["Rust"]}`, nickname))
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	status, body := s.getPerson(location)
+	s.Equal(http.StatusOK, status)
+	s.Equal("John Doe", body["name"])
+	s.Equal(nickname, body["apelido"])
+	s.Equal("1990-01-01", body["nascimento"])
+	s.Equal([]interface{}{"Rust"}, body["stack"])
 
+	resp = s.send("PATCH", location, `{"stack":null}`)
 	s.Equal(http.StatusOK, resp.StatusCode)
+
+	_, body = s.getPerson(location)
+	s.Nil(body["stack"])
+}
+
+func (s *APITestSuite) TestPatchPersonInvalid() {
+	location := s.createPerson(AddPersonRequest{
+		Name:      "John Doe",
+		Nickname:  s.nickname(),
+		Birthdate: "1990-01-01",
+	})
+
+	resp := s.send("PATCH", location, `{"nome":null}`)
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = s.send("PATCH", location, `{"stack":"Go"}`)
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = s.send("PATCH", location, `[]`)
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+
+	_, body := s.getPerson(location)
+	s.Equal("John Doe", body["name"])
+}
+
+func (s *APITestSuite) TestPatchPersonNotFound() {
+	resp := s.send("PATCH", "/pessoas/2c1f1b43-5a3c-4d4a-9f0e-1a2b3c4d5e6f", `{"nome":"Jane Doe"}`)
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *APITestSuite) TestDeletePerson() {
+	location := s.createPerson(AddPersonRequest{
+		Name:      "John Doe",
+		Nickname:  s.nickname(),
+		Birthdate: "1990-01-01",
+	})
+
+	resp := s.send("DELETE", location, "")
+	s.Equal(http.StatusNoContent, resp.StatusCode)
+
+	status, _ := s.getPerson(location)
+	s.Equal(http.StatusNotFound, status)
+
+	resp = s.send("DELETE", location, "")
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *APITestSuite) TestAddPersonNicknameTaken() {
+	request := AddPersonRequest{
+		Name:      "John Doe",
+		Nickname:  s.nickname(),
+		Birthdate: "1990-01-01",
+	}
+
+	s.createPerson(request)
+
+	jsonRequest, _ := json.Marshal(request)
+	resp := s.send("POST", "/pessoas", string(jsonRequest))
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+
+	var body ErrorResponse
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&body))
+	s.Equal(ErrNicknameTaken.Error(), body.Error)
+}
+
+func (s *APITestSuite) TestAddPersonNicknameTakenConcurrently() {
+	request := AddPersonRequest{
+		Name:      "John Doe",
+		Nickname:  s.nickname(),
+		Birthdate: "1990-01-01",
+	}
+	jsonRequest, _ := json.Marshal(request)
+
+	const attempts = 10
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, attempts)
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/pessoas", bytes.NewReader(jsonRequest))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp, err := s.app.Test(req, testTimeout)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	wg.Wait()
+	close(statuses)
+
+	created := 0
+	for status := range statuses {
+		if status == http.StatusCreated {
+			created++
+			continue
+		}
+		s.Equal(http.StatusUnprocessableEntity, status)
+	}
+
+	s.Equal(1, created)
+}
+
+func (s *APITestSuite) addPeople(body string) (int, AddPeopleResponse) {
+	resp := s.send("POST", "/pessoas/lote", body)
+
+	var response AddPeopleResponse
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+
+	return resp.StatusCode, response
+}
+
+func (s *APITestSuite) TestAddPeople() {
+	taken := s.nickname()
+	s.createPerson(AddPersonRequest{Name: "John Doe", Nickname: taken, Birthdate: "1990-01-01"})
+
+	first, second := s.nickname(), s.nickname()
+
+	status, response := s.addPeople(fmt.Sprintf(`[
+		{"nome": "Jane Doe", "apelido": %q, "nascimento": "1990-01-01", "stack": ["Go"]},
+		{"nome": "Bad Date", "apelido": %q, "nascimento": "01/01/1990"},
+		{"nome": "Taken", "apelido": %q, "nascimento": "1990-01-01"},
+		"not a person",
+		{"nome": "Jane Again", "apelido": %q, "nascimento": "1990-01-01"},
+		{"nome": "Jim Doe", "apelido": %q, "nascimento": "1990-01-01"}
+	]`, first, s.nickname(), taken, first, second))
+
+	s.Equal(http.StatusOK, status)
+	s.Equal(2, response.Added)
+	s.Equal(4, response.Rejected)
+	s.Require().Len(response.Resultados, 6)
+
+	for i, result := range response.Resultados {
+		s.Equal(i, result.Index)
+	}
+
+	s.NotEmpty(response.Resultados[0].UUID)
+	s.Equal(ErrInvalidBirthdate.Error(), response.Resultados[1].Error)
+	s.Equal(ErrNicknameTaken.Error(), response.Resultados[2].Error)
+	s.Equal(ErrInvalidPerson.Error(), response.Resultados[3].Error)
+	s.Equal(ErrNicknameTaken.Error(), response.Resultados[4].Error)
+	s.Empty(response.Resultados[5].Error)
+
+	status, body := s.getPerson("/pessoas/" + response.Resultados[0].UUID)
+	s.Equal(http.StatusOK, status)
+	s.Equal(first, body["apelido"])
+}
+
+func (s *APITestSuite) TestAddPeopleNDJSON() {
+	status, response := s.addPeople(fmt.Sprintf(
+		"{\"nome\": \"Jane Doe\", \"apelido\": %q, \"nascimento\": \"1990-01-01\"}\n\n{\"nome\": \"\", \"nascimento\": \"1990-01-01\"}\n",
+		s.nickname()))
+
+	s.Equal(http.StatusOK, status)
+	s.Equal(1, response.Added)
+	s.Require().Len(response.Resultados, 2)
+	s.NotEmpty(response.Resultados[0].UUID)
+	s.Equal(ErrInvalidName.Error(), response.Resultados[1].Error)
+
+	status, _ = s.addPeople(`[{"nome": "Jane Doe"`)
+	s.Equal(http.StatusBadRequest, status)
+}
+
+func (s *APITestSuite) export(location string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest("GET", location, nil)
+	s.Require().NoError(err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := s.app.Test(req, testTimeout)
+	s.Require().NoError(err)
+
+	body, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+
+	return resp, string(body)
+}
+
+func (s *APITestSuite) TestExportPeople() {
+	var nicknames []string
+	for i := 0; i < 3; i++ {
+		nickname := s.nickname()
+		s.createPerson(AddPersonRequest{Name: "Exported, Person", Nickname: nickname, Birthdate: "1990-01-01", Stack: []string{"Go", "C"}})
+		nicknames = append(nicknames, nickname)
+	}
+
+	resp, body := s.export("/pessoas/export?t=exported", nil)
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	s.Require().Len(lines, 3)
+	for i, line := range lines {
+		var p map[string]interface{}
+		s.Require().NoError(json.Unmarshal([]byte(line), &p))
+		s.Equal(nicknames[i], p["apelido"])
+		s.Equal("1990-01-01", p["nascimento"])
+	}
+
+	resp, body = s.export("/pessoas/export?format=csv&t=exported", nil)
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	s.Require().NoError(err)
+	s.Require().Len(records, 4)
+	s.Equal(exportHeader, records[0])
+	s.Equal([]string{nicknames[0], "Exported, Person", "1990-01-01", `["Go","C"]`}, records[1][1:])
+
+	resp, body = s.export("/pessoas/export?t=exported", http.Header{"Accept-Encoding": {"gzip"}})
+	s.Equal("gzip", resp.Header.Get("Content-Encoding"))
+
+	reader, err := gzip.NewReader(strings.NewReader(body))
+	s.Require().NoError(err)
+	decompressed, err := io.ReadAll(reader)
+	s.Require().NoError(err)
+	s.Equal(strings.Join(lines, "\n")+"\n", string(decompressed))
+
+	resp, _ = s.export("/pessoas/export?format=xml", nil)
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *APITestSuite) TestUpdatePersonNicknameTaken() {
+	taken := s.nickname()
+	s.createPerson(AddPersonRequest{Name: "John Doe", Nickname: taken, Birthdate: "1990-01-01"})
+	location := s.createPerson(AddPersonRequest{Name: "Jane Doe", Nickname: s.nickname(), Birthdate: "1990-01-01"})
+
+	resp := s.send("PATCH", location, fmt.Sprintf(`{"apelido":"%v"}`, taken))
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func (s *APITestSuite) getPeople(location string) (int, GetPeopleResponse) {
+	req, err := http.NewRequest("GET", location, nil)
+	s.Require().NoError(err)
+
+	resp, err := s.app.Test(req, testTimeout)
+	s.Require().NoError(err)
+
+	var body GetPeopleResponse
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+
+	return resp.StatusCode, body
+}
+
+func (s *APITestSuite) TestGetPeoplePagination() {
+	for i := 0; i < 7; i++ {
+		s.createPerson(AddPersonRequest{
+			Name:      "Paginated Person",
+			Nickname:  s.nickname(),
+			Birthdate: "1990-01-01",
+			Stack:     []string{"Cobol"},
+		})
+	}
+
+	status, page := s.getPeople("/pessoas?t=cobol")
+	s.Equal(http.StatusOK, status)
+	s.Len(page.Resultados, 5)
+	s.Equal(5, page.Qtd)
+	s.Equal(1, page.Pagina)
+	s.Require().NotNil(page.Proxima)
+
+	next, err := url.Parse(*page.Proxima)
+	s.Require().NoError(err)
+
+	status, page = s.getPeople(next.RequestURI())
+	s.Equal(http.StatusOK, status)
+	s.Len(page.Resultados, 2)
+	s.Equal(2, page.Qtd)
+	s.Equal(2, page.Pagina)
+	s.Nil(page.Proxima)
+
+	token := next.Query().Get("pagina")
+
+	status, _ = s.getPeople("/pessoas?t=python&pagina=" + token)
+	s.Equal(http.StatusBadRequest, status)
+
+	status, _ = s.getPeople("/pessoas?t=cobol&pagina=x" + token[1:])
+	s.Equal(http.StatusBadRequest, status)
+
+	status, _ = s.getPeople("/pessoas?t=cobol&pagina=5-1690000000")
+	s.Equal(http.StatusBadRequest, status)
+}
+
+func (s *APITestSuite) TestGetPeoplePreviousPage() {
+	for i := 0; i < 7; i++ {
+		s.createPerson(AddPersonRequest{
+			Name:      "Walking Person",
+			Nickname:  s.nickname(),
+			Birthdate: "1990-01-01",
+			Stack:     []string{"Pascal"},
+		})
+	}
+
+	status, first := s.getPeople("/pessoas?t=pascal&tamanho=3")
+	s.Equal(http.StatusOK, status)
+	s.Nil(first.Anterior)
+	s.Require().NotNil(first.Proxima)
+
+	next, err := url.Parse(*first.Proxima)
+	s.Require().NoError(err)
+
+	status, second := s.getPeople(next.RequestURI())
+	s.Equal(http.StatusOK, status)
+	s.Equal(2, second.Pagina)
+	s.Require().NotNil(second.Anterior)
+
+	previous, err := url.Parse(*second.Anterior)
+	s.Require().NoError(err)
+	s.Equal("pascal", previous.Query().Get("t"))
+	s.Equal("3", previous.Query().Get("tamanho"))
+	s.Empty(previous.Query().Get("paginationStack"))
+
+	status, back := s.getPeople(previous.RequestURI())
+	s.Equal(http.StatusOK, status)
+	s.Equal(1, back.Pagina)
+	s.Equal(first.Resultados, back.Resultados)
+	s.Nil(back.Anterior)
+	s.Require().NotNil(back.Proxima)
+
+	// the next link of the page we walked back to leads forward again
+	next, err = url.Parse(*back.Proxima)
+	s.Require().NoError(err)
+
+	status, again := s.getPeople(next.RequestURI())
+	s.Equal(http.StatusOK, status)
+	s.Equal(second.Resultados, again.Resultados)
+}
+
+func (s *APITestSuite) TestGetPeoplePageSize() {
+	for i := 0; i < 6; i++ {
+		s.createPerson(AddPersonRequest{
+			Name:      "Sized Person",
+			Nickname:  s.nickname(),
+			Birthdate: "1990-01-01",
+			Stack:     []string{"Fortran"},
+		})
+	}
+
+	status, page := s.getPeople("/pessoas?t=fortran&tamanho=4")
+	s.Equal(http.StatusOK, status)
+	s.Equal(4, page.Qtd)
+	s.Require().NotNil(page.Proxima)
+
+	next, err := url.Parse(*page.Proxima)
+	s.Require().NoError(err)
+	s.Equal("4", next.Query().Get("tamanho"))
+
+	status, page = s.getPeople(next.RequestURI())
+	s.Equal(http.StatusOK, status)
+	s.Equal(2, page.Qtd)
+	s.Nil(page.Proxima)
+
+	// exactly one full page has no next page
+	status, page = s.getPeople("/pessoas?t=fortran&tamanho=6")
+	s.Equal(http.StatusOK, status)
+	s.Equal(6, page.Qtd)
+	s.Nil(page.Proxima)
+
+	status, page = s.getPeople("/pessoas?t=fortran&tamanho=0")
+	s.Equal(http.StatusOK, status)
+	s.Equal(minPageSize, page.Qtd)
+
+	status, page = s.getPeople("/pessoas?t=fortran&tamanho=1000")
+	s.Equal(http.StatusOK, status)
+	s.Equal(6, page.Qtd)
+
+	status, _ = s.getPeople("/pessoas?t=fortran&tamanho=abc")
+	s.Equal(http.StatusBadRequest, status)
+}
+
+// blockingStore holds every GetPerson call until release is closed,
+// counting them
+type blockingStore struct {
+	persistence.Store
+	calls   atomic.Int64
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) GetPerson(ctx context.Context, id string) (*person.Person, error) {
+	if b.calls.Add(1) == 1 {
+		close(b.entered)
+	}
+	<-b.release
+	return b.Store.GetPerson(ctx, id)
+}
+
+func (s *APITestSuite) TestGetPersonCoalescesLookups() {
+	memoryStore, err := memory.NewMemoryStore("")
+	s.Require().NoError(err)
+
+	id := uuid.NewString()
+	_, err = memoryStore.AddPerson(context.Background(), person.Person{UUID: id, Name: "John Doe", Nickname: "johndoe"})
+	s.Require().NoError(err)
+
+	store := &blockingStore{Store: memoryStore, entered: make(chan struct{}), release: make(chan struct{})}
+	handler := &PeopleHandler{store: store}
+
+	app := fiber.New()
+	app.Get("/pessoas/:id", handler.GetPerson)
+
+	const requests = 20
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, requests)
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/pessoas/"+id, nil)
+
+			resp, err := app.Test(req, testTimeout)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	// give the other requests time to queue up behind the first lookup
+	<-store.entered
+	time.Sleep(100 * time.Millisecond)
+	close(store.release)
+
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		s.Equal(http.StatusOK, status)
+	}
+
+	s.Equal(int64(1), store.calls.Load())
+}
+
+// fullStore rejects every person as if its write queue was full
+type fullStore struct {
+	persistence.Store
+}
+
+func (fullStore) AddPerson(context.Context, person.Person) (int64, error) {
+	return 0, persistence.ErrQueueFull
+}
+
+func (s *APITestSuite) TestAddPersonQueueFull() {
+	handler := &PeopleHandler{store: fullStore{}}
+
+	app := fiber.New()
+	app.Post("/pessoas", handler.AddPerson)
+
+	body := `{"nome": "John Doe", "apelido": "johndoe", "nascimento": "1990-01-01"}`
+	req, err := http.NewRequest("POST", "/pessoas", bytes.NewReader([]byte(body)))
+	s.Require().NoError(err)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := app.Test(req, testTimeout)
+	s.Require().NoError(err)
+	s.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	s.Equal("1", resp.Header.Get("Retry-After"))
 }
 
 func TestAPI(t *testing.T) {
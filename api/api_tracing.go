@@ -0,0 +1,83 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the request spans
+const instrumentationName = "rinha-backend-go/api"
+
+// headerCarrier exposes the headers of a request to the propagators
+type headerCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (c headerCarrier) Get(key string) string {
+	return string(c.header.Peek(key))
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	c.header.Set(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	var keys []string
+	c.header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// httpTracing creates a span for every request, continuing the trace of the
+// W3C traceparent header when the caller sent one
+type httpTracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newHTTPTracing(provider trace.TracerProvider) *httpTracing {
+	return &httpTracing{
+		tracer:     provider.Tracer(instrumentationName),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// middleware traces the requests served by the next handlers, which find
+// the span in ctx.UserContext(). A streamed response is traced until its
+// handler returns, not until it is sent.
+func (t *httpTracing) middleware(ctx *fiber.Ctx) error {
+	parent := t.propagator.Extract(ctx.UserContext(), headerCarrier{&ctx.Request().Header})
+
+	method := ctx.Method()
+
+	spanCtx, span := t.tracer.Start(parent, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethod(method), semconv.URLPath(ctx.Path())),
+	)
+	defer span.End()
+
+	ctx.SetUserContext(spanCtx)
+
+	err := ctx.Next()
+
+	route, status := served(ctx, err)
+
+	// the route is only known once the router matched it
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPStatusCode(status))
+
+	if status >= fiber.StatusInternalServerError {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.SetStatus(codes.Error, utils.StatusMessage(status))
+	}
+
+	return err
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"rinha-backend-go/persistence/memory"
+	"rinha-backend-go/persistence/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+
+	server := New(tracing.NewStore(store, provider), Options{TracerProvider: provider})
+	server.setupApp()
+
+	req, err := http.NewRequest("GET", "/pessoas/unknown", nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	resp, err := server.fiberApp.Test(req, testTimeout)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	get, request := spans[0], spans[1]
+
+	// the request continues the trace of the caller
+	require.Equal(t, "GET /pessoas/:id", request.Name)
+	require.Equal(t, trace.SpanKindServer, request.SpanKind)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", request.SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", request.Parent.SpanID().String())
+	require.True(t, request.Parent.IsRemote())
+	require.Contains(t, request.Attributes, attribute.String("http.route", "/pessoas/:id"))
+	require.Contains(t, request.Attributes, attribute.Int("http.status_code", http.StatusNotFound))
+
+	require.Equal(t, "store.GetPerson", get.Name)
+	require.Equal(t, request.SpanContext.SpanID(), get.Parent.SpanID())
+}
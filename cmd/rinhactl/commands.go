@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/postgres"
+	"rinha-backend-go/person"
+)
+
+// importBatchSize is the number of people added per BatchAddPeople call by
+// import and seed
+const importBatchSize = 500
+
+func migrate(_ context.Context, c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	if !strings.HasPrefix(c.dsn, "postgres://") && !strings.HasPrefix(c.dsn, "postgresql://") {
+		return errors.New("migrations only apply to Postgres, the other stores create their schema when opened")
+	}
+
+	dbm, err := postgres.NewMigrator(c.dsn)
+	if err != nil {
+		return err
+	}
+
+	dbm.Log = c.out
+	// the schema file belongs to the repository, not to where this runs
+	dbm.AutoDumpSchema = false
+
+	switch args[0] {
+	case "up":
+		return dbm.CreateAndMigrate()
+	case "down":
+		return dbm.Rollback()
+	case "status":
+		_, err := dbm.Status(false)
+		return err
+	default:
+		return errUsage
+	}
+}
+
+// exported is a person as written by export and GET /pessoas/export
+type exported struct {
+	UUID      string   `json:"uuid"`
+	Name      string   `json:"name"`
+	Nickname  string   `json:"apelido"`
+	Birthdate string   `json:"nascimento"`
+	Stack     []string `json:"stack"`
+}
+
+// person validates the entry like the API does. The UUID is kept, or a new
+// one is generated when it is missing or invalid.
+func (e exported) person() (person.Person, error) {
+	p, err := person.New(e.Name, e.Nickname, e.Birthdate, e.Stack)
+	if err != nil {
+		return person.Person{}, err
+	}
+
+	p.UUID = e.UUID
+	if _, err := uuid.Parse(p.UUID); err != nil {
+		p.UUID = uuid.NewString()
+	}
+
+	return p, nil
+}
+
+// importer adds people in batches, counting those whose nickname was taken
+type importer struct {
+	store    persistence.Store
+	batch    []person.Person
+	added    int
+	rejected int
+}
+
+func (i *importer) add(ctx context.Context, p person.Person) error {
+	i.batch = append(i.batch, p)
+
+	if len(i.batch) < importBatchSize {
+		return nil
+	}
+
+	return i.flush(ctx)
+}
+
+func (i *importer) flush(ctx context.Context) error {
+	if len(i.batch) == 0 {
+		return nil
+	}
+
+	ids, err := i.store.BatchAddPeople(ctx, i.batch)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if id == 0 {
+			i.rejected++
+		} else {
+			i.added++
+		}
+	}
+
+	i.batch = i.batch[:0]
+
+	return nil
+}
+
+func importPeople(ctx context.Context, c *cli, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	in := c.in
+
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		in = file
+	}
+
+	return c.withStore(func(store persistence.Store) error {
+		imports := &importer{store: store}
+
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			var entry exported
+			if err := json.Unmarshal([]byte(text), &entry); err != nil {
+				fmt.Fprintf(c.err, "line %v: %v\n", line, person.ErrInvalidPerson)
+				imports.rejected++
+				continue
+			}
+
+			p, err := entry.person()
+			if err != nil {
+				fmt.Fprintf(c.err, "line %v: %v\n", line, err)
+				imports.rejected++
+				continue
+			}
+
+			if err := imports.add(ctx, p); err != nil {
+				return err
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+
+		if err := imports.flush(ctx); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(c.out, "Imported %v people, rejected %v\n", imports.added, imports.rejected)
+
+		return nil
+	})
+}
+
+func exportPeople(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags("export")
+	term := flags.String("t", "", "only export the people matching the term")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	return c.withStore(func(store persistence.Store) error {
+		people, err := store.IteratePeople(ctx, *term)
+		if err != nil {
+			return err
+		}
+		defer people.Close()
+
+		for people.Next() {
+			if err := writeJSON(c.out, people.Person()); err != nil {
+				return err
+			}
+		}
+
+		return people.Err()
+	})
+}
+
+func count(ctx context.Context, c *cli, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	return c.withStore(func(store persistence.Store) error {
+		count, err := store.GetPeopleCount(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(c.out, count)
+		return err
+	})
+}
+
+func get(ctx context.Context, c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return c.withStore(func(store persistence.Store) error {
+		p, err := store.GetPerson(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		return writeJSON(c.out, p)
+	})
+}
+
+var searchModes = map[string]persistence.SearchMode{
+	"substring":  persistence.SearchSubstring,
+	"prefix":     persistence.SearchPrefix,
+	"similarity": persistence.SearchSimilarity,
+}
+
+func search(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags("search")
+	mode := flags.String("mode", "substring", "how the term is matched: substring, prefix or similarity")
+	limit := flags.Int("limit", 50, "maximum number of people to print")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *limit <= 0 {
+		return errUsage
+	}
+
+	searchMode, ok := searchModes[*mode]
+	if !ok {
+		return errUsage
+	}
+
+	return c.withStore(func(store persistence.Store) error {
+		people, err := store.GetPeople(ctx, &persistence.GetPeopleOptions{
+			SearchQuery: flags.Arg(0),
+			SearchMode:  searchMode,
+			PageSize:    *limit,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, p := range people {
+			if err := writeJSON(c.out, p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+var (
+	seedFirstNames = []string{"Ana", "Bruno", "Carla", "Diego", "Elisa", "Fabio", "Gabriela", "Hugo", "Isabel", "João"}
+	seedLastNames  = []string{"Silva", "Santos", "Oliveira", "Souza", "Lima", "Pereira", "Costa", "Almeida"}
+	seedStack      = []string{"Go", "Rust", "Java", "Python", "C", "C#", "Node", "Ruby", "Elixir", "PHP"}
+)
+
+// seedPerson returns a random person, the nickname is random letters so
+// collisions are unlikely
+func seedPerson(random *rand.Rand) person.Person {
+	nickname := make([]byte, 12)
+	for i := range nickname {
+		nickname[i] = byte('a' + random.Intn(26))
+	}
+
+	var stack []string
+	for _, i := range random.Perm(len(seedStack))[:random.Intn(4)] {
+		stack = append(stack, seedStack[i])
+	}
+
+	return person.Person{
+		UUID:      uuid.NewString(),
+		Name:      seedFirstNames[random.Intn(len(seedFirstNames))] + " " + seedLastNames[random.Intn(len(seedLastNames))],
+		Nickname:  string(nickname),
+		Birthdate: time.Date(1950+random.Intn(55), time.Month(1+random.Intn(12)), 1+random.Intn(28), 0, 0, 0, 0, time.UTC),
+		Stack:     stack,
+	}
+}
+
+func seed(ctx context.Context, c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return errUsage
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	return c.withStore(func(store persistence.Store) error {
+		imports := &importer{store: store}
+
+		for i := 0; i < n; i++ {
+			if err := imports.add(ctx, seedPerson(random)); err != nil {
+				return err
+			}
+		}
+
+		if err := imports.flush(ctx); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(c.out, "Seeded %v people, rejected %v\n", imports.added, imports.rejected)
+
+		return nil
+	})
+}
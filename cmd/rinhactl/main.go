@@ -0,0 +1,181 @@
+// Command rinhactl runs admin operations against a people store:
+//
+//	rinhactl [-dsn DSN] command [arguments]
+//
+// The store is picked by the DSN scheme: postgres://..., sqlite://PATH or
+// memory://[SNAPSHOT]. The DSN defaults to the DSN environment variable, the
+// same the server reads.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/goccy/go-json"
+
+	"rinha-backend-go/persistence"
+	_ "rinha-backend-go/persistence/memory"
+	_ "rinha-backend-go/persistence/postgres"
+	_ "rinha-backend-go/persistence/sqlite"
+)
+
+// errUsage is returned when a command is called with the wrong arguments
+var errUsage = errors.New("invalid arguments")
+
+type command struct {
+	usage       string
+	description string
+	run         func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"migrate": {"migrate up|down|status", "apply, roll back or list the Postgres migrations", migrate},
+	"import":  {"import [FILE]", "add the people of an NDJSON export, from stdin when FILE is omitted", importPeople},
+	"export":  {"export [-t TERM]", "write every person, or those matching TERM, as NDJSON", exportPeople},
+	"count":   {"count", "print the number of people", count},
+	"get":     {"get UUID", "print a person as JSON", get},
+	"search":  {"search [-mode substring|prefix|similarity] [-limit N] TERM", "print the people matching TERM as NDJSON", search},
+	"seed":    {"seed N", "add N synthetic people", seed},
+}
+
+// cli holds what the commands share: the DSN and the standard streams
+type cli struct {
+	dsn string
+	in  io.Reader
+	out io.Writer
+	err io.Writer
+}
+
+// open opens the store selected by the DSN scheme, close releases it and,
+// for a memory store, writes its snapshot
+func (c *cli) open() (store persistence.Store, close func() error, err error) {
+	if c.dsn == "" {
+		return nil, nil, errors.New("no DSN, set -dsn or the DSN environment variable")
+	}
+
+	store, err = persistence.Open(c.dsn, persistence.OpenOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	close = func() error { return nil }
+	if closer, ok := store.(io.Closer); ok {
+		close = closer.Close
+	}
+
+	return store, close, nil
+}
+
+// withStore runs fn with the store, closing it afterwards
+func (c *cli) withStore(fn func(store persistence.Store) error) (err error) {
+	store, close, err := c.open()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if closeErr := close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	return fn(store)
+}
+
+// flags returns a flag set for a subcommand that reports errors instead of
+// exiting
+func (c *cli) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.err)
+	return flags
+}
+
+func (c *cli) usage() {
+	fmt.Fprintln(c.err, "usage: rinhactl [-dsn DSN] command [arguments]")
+	fmt.Fprintln(c.err)
+	fmt.Fprintln(c.err, "commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(c.err, "  %-60s %s\n", commands[name].usage, commands[name].description)
+	}
+}
+
+// run parses the global flags and runs the command in args
+func (c *cli) run(ctx context.Context, args []string) error {
+	flags := c.flags("rinhactl")
+	flags.StringVar(&c.dsn, "dsn", os.Getenv("DSN"), "store DSN: postgres://..., sqlite://PATH or memory://[SNAPSHOT]")
+	flags.Usage = c.usage
+
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if flags.NArg() == 0 {
+		c.usage()
+		return errUsage
+	}
+
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		c.usage()
+		return errUsage
+	}
+
+	err := cmd.run(ctx, c, flags.Args()[1:])
+	if err == errUsage {
+		fmt.Fprintln(c.err, "usage: rinhactl", cmd.usage)
+	}
+
+	return err
+}
+
+func main() {
+	log.SetFlags(0)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// the commands write a line per person, buffer them
+	out := bufio.NewWriter(os.Stdout)
+
+	c := &cli{in: os.Stdin, out: out, err: os.Stderr}
+
+	err := c.run(ctx, os.Args[1:])
+
+	if flushErr := out.Flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+
+	if err == errUsage {
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal("rinhactl: ", err)
+	}
+}
+
+// writeJSON writes v on its own line
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/persistence"
+)
+
+// rinhactl runs the command line with stdin as input and returns its output
+func rinhactl(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+
+	var out, errOut bytes.Buffer
+	c := &cli{in: strings.NewReader(stdin), out: &out, err: &errOut}
+
+	err := c.run(context.Background(), args)
+
+	return out.String(), err
+}
+
+// export seeds a snapshot with count people and returns its NDJSON export
+func export(t *testing.T, count int) string {
+	t.Helper()
+
+	snapshot := "memory://" + filepath.Join(t.TempDir(), "people.json")
+
+	out, err := rinhactl(t, "", "-dsn", snapshot, "seed", strconv.Itoa(count))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("Seeded %d people, rejected 0\n", count), out)
+
+	exported, err := rinhactl(t, "", "-dsn", snapshot, "export")
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(exported), "\n"), count)
+
+	return exported
+}
+
+// testImport imports the 600 people of exported into the empty store of dsn
+func testImport(t *testing.T, exported string, dsn string) {
+	t.Helper()
+
+	out, err := rinhactl(t, exported+"\nnot json\n", "-dsn", dsn, "import")
+	require.NoError(t, err)
+	require.Equal(t, "Imported 600 people, rejected 1\n", out)
+
+	out, err = rinhactl(t, "", "-dsn", dsn, "count")
+	require.NoError(t, err)
+	require.Equal(t, "600\n", out)
+
+	// the UUIDs are kept, so the people can be looked up as they were
+	first := exported[:strings.Index(exported, "\n")]
+	id := first[strings.Index(first, `"uuid":"`)+8:]
+	id = id[:strings.Index(id, `"`)]
+
+	out, err = rinhactl(t, "", "-dsn", dsn, "get", id)
+	require.NoError(t, err)
+	require.JSONEq(t, first, out)
+
+	out, err = rinhactl(t, exported, "-dsn", dsn, "import")
+	require.NoError(t, err)
+	require.Equal(t, "Imported 0 people, rejected 600\n", out)
+}
+
+func TestSeedExportImport(t *testing.T) {
+	testImport(t, export(t, 600), "memory://"+filepath.Join(t.TempDir(), "imported.json"))
+}
+
+func TestUsage(t *testing.T) {
+	_, err := rinhactl(t, "")
+	require.Equal(t, errUsage, err)
+
+	_, err = rinhactl(t, "", "-dsn", "memory://", "seed", "many")
+	require.Equal(t, errUsage, err)
+
+	_, err = rinhactl(t, "", "-dsn", "mysql://localhost", "count")
+	require.ErrorIs(t, err, persistence.ErrUnknownScheme)
+}
@@ -0,0 +1,12 @@
+//go:build cgo
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteImport(t *testing.T) {
+	testImport(t, export(t, 600), "sqlite://"+filepath.Join(t.TempDir(), "people.db"))
+}
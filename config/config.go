@@ -0,0 +1,426 @@
+// Package config loads the server settings from their defaults, an optional
+// YAML or TOML file, the environment and the command line flags, each
+// overriding the previous one.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type DatabaseConfig struct {
+	MaxOpenConns int `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns int `yaml:"max_idle_conns" toml:"max_idle_conns"`
+}
+
+type CacheConfig struct {
+	// RedisAddress shares the cache between the instances, people are only
+	// cached in process when it is empty
+	RedisAddress string        `yaml:"redis_address" toml:"redis_address"`
+	TTL          time.Duration `yaml:"ttl" toml:"ttl"`
+	NotFoundTTL  time.Duration `yaml:"not_found_ttl" toml:"not_found_ttl"`
+	SearchTTL    time.Duration `yaml:"search_ttl" toml:"search_ttl"`
+	// SearchInvalidation bounds how often the writes drop the cached search
+	// results, so they still hit under a steady write load
+	SearchInvalidation time.Duration `yaml:"search_invalidation" toml:"search_invalidation"`
+	// LocalBytes bounds the people cached in process
+	LocalBytes int64 `yaml:"local_bytes" toml:"local_bytes"`
+	// LocalTTL bounds how long an instance may serve a person changed by
+	// another instance when an invalidation is lost
+	LocalTTL time.Duration `yaml:"local_ttl" toml:"local_ttl"`
+}
+
+type TimeoutsConfig struct {
+	Read     time.Duration `yaml:"read" toml:"read"`
+	Write    time.Duration `yaml:"write" toml:"write"`
+	Idle     time.Duration `yaml:"idle" toml:"idle"`
+	Shutdown time.Duration `yaml:"shutdown" toml:"shutdown"`
+	// Drain is how long the server keeps serving once it reports not ready
+	Drain time.Duration `yaml:"drain" toml:"drain"`
+	// Check bounds each dependency probe of the readiness endpoint
+	Check time.Duration `yaml:"check" toml:"check"`
+	// Request is the deadline of the store calls of a request, Routes
+	// overrides it by route, keyed as "GET /pessoas/:id". Routes can only be
+	// set in the file.
+	Request time.Duration            `yaml:"request" toml:"request"`
+	Routes  map[string]time.Duration `yaml:"routes" toml:"routes"`
+}
+
+type PaginationConfig struct {
+	DefaultPageSize int `yaml:"default_page_size" toml:"default_page_size"`
+	MaxPageSize     int `yaml:"max_page_size" toml:"max_page_size"`
+}
+
+type TracingConfig struct {
+	// Exporter sends the spans to "otlp" or "stdout", tracing is disabled
+	// when empty. The OTLP exporter reads its endpoint from the standard
+	// OTEL_EXPORTER_OTLP_* variables.
+	Exporter    string  `yaml:"exporter" toml:"exporter"`
+	ServiceName string  `yaml:"service_name" toml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+type LoggingConfig struct {
+	// Format is "json" or "text"
+	Format string `yaml:"format" toml:"format"`
+	// Level is the lowest level logged: debug, info, warn or error
+	Level string `yaml:"level" toml:"level"`
+	// AccessSampleRatio is the fraction of the requests logged, the failed
+	// ones are always logged
+	AccessSampleRatio float64 `yaml:"access_sample_ratio" toml:"access_sample_ratio"`
+}
+
+// ParseLevel returns the slog level named by Level
+func (c LoggingConfig) ParseLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.Level))
+	return level, err
+}
+
+type Config struct {
+	// ListenAddress is the host:port the server listens on
+	ListenAddress string `yaml:"listen_address" toml:"listen_address"`
+	// DSN selects the store, see persistence.Open
+	DSN string `yaml:"dsn" toml:"dsn"`
+	// CursorSecret signs the pagination tokens, a random one is used when
+	// empty so the tokens are only valid on the instance issuing them
+	CursorSecret string `yaml:"cursor_secret" toml:"cursor_secret"`
+	// WriteBehind queues the added people and inserts them in batches. The
+	// nicknames are claimed in Redis so the instances never accept one twice,
+	// it needs a redis_address unless the store is in memory.
+	WriteBehind bool `yaml:"write_behind" toml:"write_behind"`
+
+	Database   DatabaseConfig   `yaml:"database" toml:"database"`
+	Cache      CacheConfig      `yaml:"cache" toml:"cache"`
+	Timeouts   TimeoutsConfig   `yaml:"timeouts" toml:"timeouts"`
+	Pagination PaginationConfig `yaml:"pagination" toml:"pagination"`
+	Tracing    TracingConfig    `yaml:"tracing" toml:"tracing"`
+	Logging    LoggingConfig    `yaml:"logging" toml:"logging"`
+}
+
+// Default returns the settings used when nothing overrides them
+func Default() Config {
+	return Config{
+		ListenAddress: ":8080",
+		Database: DatabaseConfig{
+			MaxOpenConns: 30,
+			MaxIdleConns: 5,
+		},
+		Cache: CacheConfig{
+			NotFoundTTL: 2 * time.Second,
+			SearchTTL:   time.Second,
+			// searches may miss the people added in the last 250ms
+			SearchInvalidation: 250 * time.Millisecond,
+			// the API containers are limited to 0.1GiB
+			LocalBytes: 16 << 20,
+			LocalTTL:   30 * time.Second,
+		},
+		Timeouts: TimeoutsConfig{
+			Shutdown: 10 * time.Second,
+			Check:    time.Second,
+			Request:  2 * time.Second,
+		},
+		Pagination: PaginationConfig{
+			DefaultPageSize: 5,
+			MaxPageSize:     50,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "rinha-backend",
+			SampleRatio: 1,
+		},
+		Logging: LoggingConfig{
+			Format:            "json",
+			Level:             "info",
+			AccessSampleRatio: 0.01,
+		},
+	}
+}
+
+// setting binds a field to its flag and environment variable
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	bind  func(flags *flag.FlagSet, name string, usage string)
+}
+
+func (c *Config) settings() []setting {
+	str := func(field *string) func(*flag.FlagSet, string, string) {
+		return func(flags *flag.FlagSet, name string, usage string) { flags.StringVar(field, name, *field, usage) }
+	}
+	integer := func(field *int) func(*flag.FlagSet, string, string) {
+		return func(flags *flag.FlagSet, name string, usage string) { flags.IntVar(field, name, *field, usage) }
+	}
+	duration := func(field *time.Duration) func(*flag.FlagSet, string, string) {
+		return func(flags *flag.FlagSet, name string, usage string) { flags.DurationVar(field, name, *field, usage) }
+	}
+
+	return []setting{
+		{"listen", "LISTEN_ADDRESS", "host:port to listen on, PORT sets the port alone", str(&c.ListenAddress)},
+		{"dsn", "DSN", "store DSN: postgres://..., sqlite://PATH or memory://[SNAPSHOT]", str(&c.DSN)},
+		{"cursor-secret", "CURSOR_SECRET", "key signing the pagination tokens", str(&c.CursorSecret)},
+		{"write-behind", "WRITE_BEHIND", "queue the added people and insert them in batches", func(flags *flag.FlagSet, name string, usage string) {
+			flags.BoolVar(&c.WriteBehind, name, c.WriteBehind, usage)
+		}},
+		{"db-max-open-conns", "DB_MAX_OPEN_CONNS", "maximum open database connections", integer(&c.Database.MaxOpenConns)},
+		{"db-max-idle-conns", "DB_MAX_IDLE_CONNS", "maximum idle database connections", integer(&c.Database.MaxIdleConns)},
+		{"redis-address", "REDIS_ADDRESS", "Redis address sharing the cache, in process only when empty", str(&c.Cache.RedisAddress)},
+		{"cache-ttl", "CACHE_TTL", "how long a person is cached, 0 until changed", duration(&c.Cache.TTL)},
+		{"cache-not-found-ttl", "CACHE_NOT_FOUND_TTL", "how long an unknown person is remembered", duration(&c.Cache.NotFoundTTL)},
+		{"cache-search-ttl", "CACHE_SEARCH_TTL", "how long search results are cached, 0 disables it", duration(&c.Cache.SearchTTL)},
+		{"cache-search-invalidation", "CACHE_SEARCH_INVALIDATION", "how often writes drop the cached search results, 0 on every write", duration(&c.Cache.SearchInvalidation)},
+		{"cache-local-bytes", "CACHE_LOCAL_BYTES", "memory bound of the in process cache", func(flags *flag.FlagSet, name string, usage string) {
+			flags.Int64Var(&c.Cache.LocalBytes, name, c.Cache.LocalBytes, usage)
+		}},
+		{"cache-local-ttl", "CACHE_LOCAL_TTL", "how long the in process cache keeps a person cached in Redis", duration(&c.Cache.LocalTTL)},
+		{"read-timeout", "READ_TIMEOUT", "maximum time to read a request, 0 is unlimited", duration(&c.Timeouts.Read)},
+		{"write-timeout", "WRITE_TIMEOUT", "maximum time to write a response, 0 is unlimited", duration(&c.Timeouts.Write)},
+		{"idle-timeout", "IDLE_TIMEOUT", "maximum time a keep-alive connection waits, 0 is unlimited", duration(&c.Timeouts.Idle)},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "maximum time to finish the in-flight requests when stopping, 0 waits forever", duration(&c.Timeouts.Shutdown)},
+		{"drain-delay", "DRAIN_DELAY", "how long to keep serving after reporting not ready when stopping", duration(&c.Timeouts.Drain)},
+		{"check-timeout", "CHECK_TIMEOUT", "maximum time of each dependency probe of /readyz", duration(&c.Timeouts.Check)},
+		{"request-timeout", "REQUEST_TIMEOUT", "deadline of the store calls of a request, 0 is unlimited", duration(&c.Timeouts.Request)},
+		{"default-page-size", "DEFAULT_PAGE_SIZE", "page size of GET /pessoas without tamanho", integer(&c.Pagination.DefaultPageSize)},
+		{"max-page-size", "MAX_PAGE_SIZE", "largest page size of GET /pessoas", integer(&c.Pagination.MaxPageSize)},
+		{"tracing-exporter", "TRACING_EXPORTER", "span exporter: otlp or stdout, tracing is disabled when empty", str(&c.Tracing.Exporter)},
+		{"tracing-service-name", "TRACING_SERVICE_NAME", "service name of the spans", str(&c.Tracing.ServiceName)},
+		{"tracing-sample-ratio", "TRACING_SAMPLE_RATIO", "fraction of the traces started here that are sampled", func(flags *flag.FlagSet, name string, usage string) {
+			flags.Float64Var(&c.Tracing.SampleRatio, name, c.Tracing.SampleRatio, usage)
+		}},
+		{"log-format", "LOG_FORMAT", "log format: json or text", str(&c.Logging.Format)},
+		{"log-level", "LOG_LEVEL", "lowest level logged: debug, info, warn or error", str(&c.Logging.Level)},
+		{"access-log-sample-ratio", "ACCESS_LOG_SAMPLE_RATIO", "fraction of the requests logged, failed requests are always logged", func(flags *flag.FlagSet, name string, usage string) {
+			flags.Float64Var(&c.Logging.AccessSampleRatio, name, c.Logging.AccessSampleRatio, usage)
+		}},
+	}
+}
+
+// Error lists every problem found in the settings
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Load reads the settings. The file is set by the -config flag or the
+// CONFIG_FILE variable, its format by its extension: .yaml, .yml or .toml.
+// getenv is os.Getenv outside of tests. Flag errors are returned as they
+// come, every other problem is gathered in an *Error.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	flags := flag.NewFlagSet("rinha-backend", flag.ContinueOnError)
+	path := flags.String("config", getenv("CONFIG_FILE"), "YAML or TOML configuration file")
+
+	settings := c.settings()
+	for _, s := range settings {
+		s.bind(flags, s.flag, s.usage+" ($"+s.env+")")
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// the flags override everything, they are applied again last
+	var given [][2]string
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			given = append(given, [2]string{f.Name, f.Value.String()})
+		}
+	})
+
+	c = Default()
+
+	var problems []string
+
+	if *path != "" {
+		if err := c.load(*path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if port := getenv("PORT"); port != "" {
+		c.ListenAddress = ":" + port
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := flags.Set(s.flag, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: invalid value %q", s.env, value))
+			}
+		}
+	}
+
+	for _, f := range given {
+		_ = flags.Set(f[0], f[1])
+	}
+
+	problems = append(problems, c.validate()...)
+
+	if len(problems) > 0 {
+		return nil, &Error{Problems: problems}
+	}
+
+	return &c, nil
+}
+
+// load reads the file at path over c, rejecting unknown keys
+func (c *Config) load(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+
+		// an empty file has no document at all
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+	case ".toml":
+		metadata, err := toml.Decode(string(content), c)
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, key := range undecoded {
+				keys = append(keys, key.String())
+			}
+			return fmt.Errorf("%v: unknown keys %v", path, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("%v: unknown configuration format, expected .yaml, .yml or .toml", path)
+	}
+
+	return nil
+}
+
+// routeMethods are the methods of the routes with a deadline
+var routeMethods = map[string]bool{"GET": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+
+func (c *Config) validate() []string {
+	var problems []string
+
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		problem("listen address %q is not host:port", c.ListenAddress)
+	}
+
+	if c.DSN == "" {
+		problem("dsn is required")
+	} else if !strings.Contains(c.DSN, "://") {
+		problem("dsn %q has no scheme, expected postgres://, sqlite:// or memory://", c.DSN)
+	}
+
+	// another instance could accept the nickname of a queued person
+	if c.WriteBehind && c.Cache.RedisAddress == "" && !strings.HasPrefix(c.DSN, "memory://") {
+		problem("write_behind needs redis_address to claim the nicknames across instances")
+	}
+
+	if c.Database.MaxOpenConns < 0 {
+		problem("database max_open_conns is negative")
+	}
+	if c.Database.MaxIdleConns < 0 {
+		problem("database max_idle_conns is negative")
+	}
+	if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		problem("database max_idle_conns (%v) exceeds max_open_conns (%v)", c.Database.MaxIdleConns, c.Database.MaxOpenConns)
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"cache ttl", c.Cache.TTL},
+		{"cache not_found_ttl", c.Cache.NotFoundTTL},
+		{"cache search_ttl", c.Cache.SearchTTL},
+		{"cache search_invalidation", c.Cache.SearchInvalidation},
+		{"cache local_ttl", c.Cache.LocalTTL},
+		{"read timeout", c.Timeouts.Read},
+		{"write timeout", c.Timeouts.Write},
+		{"idle timeout", c.Timeouts.Idle},
+		{"shutdown timeout", c.Timeouts.Shutdown},
+		{"drain timeout", c.Timeouts.Drain},
+		{"check timeout", c.Timeouts.Check},
+		{"request timeout", c.Timeouts.Request},
+	}
+
+	for _, d := range durations {
+		if d.value < 0 {
+			problem("%v is negative", d.name)
+		}
+	}
+
+	routes := make([]string, 0, len(c.Timeouts.Routes))
+	for route := range c.Timeouts.Routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		switch {
+		case !routeMethods[method] || !strings.HasPrefix(path, "/"):
+			problem("route timeout %q is not METHOD /path", route)
+		case c.Timeouts.Routes[route] < 0:
+			problem("route timeout %q is negative", route)
+		}
+	}
+
+	if c.Cache.LocalBytes < 0 {
+		problem("cache local_bytes is negative")
+	}
+
+	if c.Pagination.DefaultPageSize < 1 {
+		problem("default_page_size must be at least 1")
+	}
+	if c.Pagination.MaxPageSize < c.Pagination.DefaultPageSize {
+		problem("max_page_size (%v) is below default_page_size (%v)", c.Pagination.MaxPageSize, c.Pagination.DefaultPageSize)
+	}
+
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		problem("tracing exporter %q is unknown, expected otlp or stdout", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("tracing sample_ratio must be between 0 and 1")
+	}
+
+	switch c.Logging.Format {
+	case "json", "text":
+	default:
+		problem("log format %q is unknown, expected json or text", c.Logging.Format)
+	}
+	if _, err := c.Logging.ParseLevel(); err != nil {
+		problem("log level %q is unknown, expected debug, info, warn or error", c.Logging.Level)
+	}
+	if c.Logging.AccessSampleRatio < 0 || c.Logging.AccessSampleRatio > 1 {
+		problem("logging access_sample_ratio must be between 0 and 1")
+	}
+
+	return problems
+}
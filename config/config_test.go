@@ -0,0 +1,168 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// env returns a getenv reading from variables
+func env(variables map[string]string) func(string) string {
+	return func(name string) string { return variables[name] }
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	c, err := Load(nil, env(map[string]string{"DSN": "memory://", "PORT": "9999"}))
+	require.NoError(t, err)
+
+	expected := Default()
+	expected.DSN = "memory://"
+	expected.ListenAddress = ":9999"
+	require.Equal(t, &expected, c)
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+dsn: postgres://file
+listen_address: "127.0.0.1:7000"
+database:
+  max_open_conns: 10
+cache:
+  search_ttl: 5s
+  redis_address: cache:6379
+pagination:
+  max_page_size: 20
+timeouts:
+  routes:
+    GET /pessoas: 500ms
+`)
+
+	c, err := Load(
+		[]string{"-config", path, "-max-page-size", "30", "-write-behind"},
+		env(map[string]string{
+			"DSN":               "postgres://env",
+			"PORT":              "9999",
+			"MAX_PAGE_SIZE":     "40",
+			"DB_MAX_IDLE_CONNS": "2",
+		}),
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, "postgres://env", c.DSN)
+	// PORT replaces the address of the file
+	require.Equal(t, ":9999", c.ListenAddress)
+	require.Equal(t, 10, c.Database.MaxOpenConns)
+	require.Equal(t, 2, c.Database.MaxIdleConns)
+	require.Equal(t, 5*time.Second, c.Cache.SearchTTL)
+	require.Equal(t, "cache:6379", c.Cache.RedisAddress)
+	require.Equal(t, 30, c.Pagination.MaxPageSize)
+	require.Equal(t, map[string]time.Duration{"GET /pessoas": 500 * time.Millisecond}, c.Timeouts.Routes)
+	require.True(t, c.WriteBehind)
+	require.Equal(t, Default().Cache.LocalTTL, c.Cache.LocalTTL)
+
+	c, err = Load(nil, env(map[string]string{"DSN": "memory://", "PORT": "9999", "LISTEN_ADDRESS": "localhost:80"}))
+	require.NoError(t, err)
+	require.Equal(t, "localhost:80", c.ListenAddress)
+}
+
+func TestTOML(t *testing.T) {
+	path := writeFile(t, "config.toml", `
+dsn = "sqlite://people.db"
+
+[timeouts]
+read = "2s"
+shutdown = "1m"
+
+[timeouts.routes]
+"POST /pessoas/lote" = "10s"
+
+[tracing]
+exporter = "otlp"
+sample_ratio = 0.1
+
+[logging]
+format = "text"
+level = "WARN"
+`)
+
+	c, err := Load(nil, env(map[string]string{"CONFIG_FILE": path}))
+	require.NoError(t, err)
+
+	require.Equal(t, "sqlite://people.db", c.DSN)
+	require.Equal(t, 2*time.Second, c.Timeouts.Read)
+	require.Equal(t, time.Minute, c.Timeouts.Shutdown)
+	require.Equal(t, 10*time.Second, c.Timeouts.Routes["POST /pessoas/lote"])
+	require.Equal(t, TracingConfig{Exporter: "otlp", ServiceName: "rinha-backend", SampleRatio: 0.1}, c.Tracing)
+	require.Equal(t, "text", c.Logging.Format)
+
+	level, err := c.Logging.ParseLevel()
+	require.NoError(t, err)
+	require.Equal(t, slog.LevelWarn, level)
+}
+
+func TestProblems(t *testing.T) {
+	_, err := Load(nil, env(map[string]string{
+		"LISTEN_ADDRESS":    "8080",
+		"CACHE_TTL":         "forever",
+		"DB_MAX_OPEN_CONNS": "2",
+		"DB_MAX_IDLE_CONNS": "3",
+		"DEFAULT_PAGE_SIZE": "0",
+		"READ_TIMEOUT":      "-1s",
+		"TRACING_EXPORTER":  "jaeger",
+		"LOG_LEVEL":         "verbose",
+	}))
+
+	var configErr *Error
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, []string{
+		`CACHE_TTL: invalid value "forever"`,
+		`listen address "8080" is not host:port`,
+		"dsn is required",
+		"database max_idle_conns (3) exceeds max_open_conns (2)",
+		"read timeout is negative",
+		"default_page_size must be at least 1",
+		`tracing exporter "jaeger" is unknown, expected otlp or stdout`,
+		`log level "verbose" is unknown, expected debug, info, warn or error`,
+	}, configErr.Problems)
+	require.Contains(t, err.Error(), "\n  - dsn is required")
+
+	path := writeFile(t, "config.yml", "dsn: memory://\ntimeouts:\n  routes:\n    /pessoas: 1s\n    GET /pessoas/:id: -1s\n")
+	_, err = Load([]string{"-config", path}, env(nil))
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, []string{
+		`route timeout "/pessoas" is not METHOD /path`,
+		`route timeout "GET /pessoas/:id" is negative`,
+	}, configErr.Problems)
+
+	// two instances could accept one nickname without Redis
+	_, err = Load([]string{"-write-behind"}, env(map[string]string{"DSN": "postgres://db"}))
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, []string{"write_behind needs redis_address to claim the nicknames across instances"}, configErr.Problems)
+
+	_, err = Load([]string{"-write-behind"}, env(map[string]string{"DSN": "memory://"}))
+	require.NoError(t, err)
+
+	path = writeFile(t, "config.yml", "dsn: memory://\npagination:\n  size: 3\n")
+	_, err = Load([]string{"-config", path}, env(nil))
+	require.ErrorAs(t, err, &configErr)
+	require.Len(t, configErr.Problems, 1)
+	require.Contains(t, configErr.Problems[0], "field size not found")
+
+	path = writeFile(t, "config.toml", "dsn = \"memory://\"\n[cache]\nttls = \"1s\"\n")
+	_, err = Load([]string{"-config", path}, env(nil))
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, []string{path + ": unknown keys cache.ttls"}, configErr.Problems)
+
+	_, err = Load([]string{"-unknown"}, env(nil))
+	require.Error(t, err)
+}
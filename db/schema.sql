@@ -16,6 +16,29 @@ SET row_security = off;
 -- *not* creating schema, since initdb creates it
 
 
+--
+-- Name: pg_trgm; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm WITH SCHEMA public;
+
+
+--
+-- Name: EXTENSION pg_trgm; Type: COMMENT; Schema: -; Owner: -
+--
+
+COMMENT ON EXTENSION pg_trgm IS 'text similarity measurement and index searching based on trigrams';
+
+
+--
+-- Name: people_search_text(character varying, character varying, character varying[]); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.people_search_text(name character varying, nickname character varying, stack character varying[]) RETURNS text
+    LANGUAGE sql IMMUTABLE PARALLEL SAFE
+    AS $$ SELECT lower(name || E'\x1f' || nickname || E'\x1f' || coalesce(array_to_string(stack, E'\x1f'), '')) $$;
+
+
 SET default_tablespace = '';
 
 SET default_table_access_method = heap;
@@ -30,8 +53,9 @@ CREATE TABLE public.people (
     name character varying(100) NOT NULL,
     nickname character varying(32) NOT NULL,
     birthdate date NOT NULL,
-    stack character varying(32)[] NOT NULL,
-    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP
+    stack character varying(32)[],
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    search text GENERATED ALWAYS AS (public.people_search_text(name, nickname, stack)) STORED
 );
 
 
@@ -102,10 +126,17 @@ CREATE INDEX people_name_idx ON public.people USING btree (name);
 
 
 --
--- Name: people_nickname_idx; Type: INDEX; Schema: public; Owner: -
+-- Name: people_nickname_key; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX people_nickname_key ON public.people USING btree (nickname);
+
+
+--
+-- Name: people_search_trgm_idx; Type: INDEX; Schema: public; Owner: -
 --
 
-CREATE INDEX people_nickname_idx ON public.people USING btree (nickname);
+CREATE INDEX people_search_trgm_idx ON public.people USING gin (search public.gin_trgm_ops);
 
 
 --
@@ -132,4 +163,7 @@ CREATE UNIQUE INDEX people_uuid_idx ON public.people USING btree (uuid);
 --
 
 INSERT INTO public.schema_migrations (version) VALUES
-    ('20230801041351');
+    ('20230801041351'),
+    ('20230815120000'),
+    ('20230820090000'),
+    ('20230827100000');
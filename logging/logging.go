@@ -0,0 +1,121 @@
+// Package logging builds the structured logger of the server. The records
+// logged with a request context carry the ID of the request.
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+)
+
+var ErrUnknownFormat = errors.New("unknown log format")
+
+// RequestIDKey is the attribute holding the request ID
+const RequestIDKey = "request_id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Handler adds the request ID of the context to the records, at the top level
+// whatever the groups of the logger
+type Handler struct {
+	slog.Handler
+
+	// root is the wrapped handler before the attributes and groups of the
+	// logger, replayed by steps on top of the request ID
+	root    slog.Handler
+	steps   []step
+	grouped bool
+}
+
+// step is a WithAttrs or a WithGroup call on the handler
+type step struct {
+	attrs []slog.Attr
+	group string
+}
+
+// NewHandler wraps handler
+func NewHandler(handler slog.Handler) *Handler {
+	return &Handler{Handler: handler, root: handler}
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	id := RequestID(ctx)
+	if id == "" {
+		return h.Handler.Handle(ctx, record)
+	}
+
+	if !h.grouped {
+		record.AddAttrs(slog.String(RequestIDKey, id))
+		return h.Handler.Handle(ctx, record)
+	}
+
+	// the attributes of the record go in the last group, the ID has to be
+	// added before the groups are opened
+	handler := h.root.WithAttrs([]slog.Attr{slog.String(RequestIDKey, id)})
+	for _, s := range h.steps {
+		if s.group != "" {
+			handler = handler.WithGroup(s.group)
+		} else {
+			handler = handler.WithAttrs(s.attrs)
+		}
+	}
+
+	return handler.Handle(ctx, record)
+}
+
+func (h *Handler) with(handler slog.Handler, s step) *Handler {
+	steps := make([]step, len(h.steps), len(h.steps)+1)
+	copy(steps, h.steps)
+
+	return &Handler{
+		Handler: handler,
+		root:    h.root,
+		steps:   append(steps, s),
+		grouped: h.grouped || s.group != "",
+	}
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return h.with(h.Handler.WithAttrs(attrs), step{attrs: attrs})
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(h.Handler.WithGroup(name), step{group: name})
+}
+
+// New returns a logger writing the records at level or above to w, as
+// "json" or "text"
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	return slog.New(NewHandler(handler)), nil
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "json", slog.LevelInfo)
+	require.NoError(t, err)
+
+	ctx := WithRequestID(context.Background(), "abc")
+	logger.With("component", "test").WithGroup("store").InfoContext(ctx, "Person added", "uuid", "1")
+	logger.DebugContext(ctx, "not logged")
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+
+	require.Equal(t, "Person added", record["msg"])
+	require.Equal(t, "test", record["component"])
+	require.Equal(t, "abc", record[RequestIDKey])
+	require.Equal(t, map[string]interface{}{"uuid": "1"}, record["store"])
+
+	// without a group the ID follows the attributes of the logger
+	out.Reset()
+	logger.With("component", "test").InfoContext(ctx, "Person added")
+
+	record = nil
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	require.Equal(t, "abc", record[RequestIDKey])
+
+	out.Reset()
+	logger.Info("Server listening")
+	require.NotContains(t, out.String(), RequestIDKey)
+
+	_, err = New(&out, "xml", slog.LevelInfo)
+	require.ErrorIs(t, err, ErrUnknownFormat)
+}
@@ -2,44 +2,232 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"flag"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"rinha-backend-go/api"
-	"rinha-backend-go/persistence/postgres"
+	"rinha-backend-go/config"
+	"rinha-backend-go/logging"
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/batch"
+	"rinha-backend-go/persistence/cache"
+	"rinha-backend-go/persistence/instrument"
+	_ "rinha-backend-go/persistence/memory"
+	_ "rinha-backend-go/persistence/postgres"
+	_ "rinha-backend-go/persistence/sqlite"
+	"rinha-backend-go/persistence/tracing"
+	"rinha-backend-go/person"
+	"rinha-backend-go/telemetry"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/v9"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"golang.org/x/sync/errgroup"
 )
 
 func main() {
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
 
-	dsn := os.Getenv("DSN")
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	level, _ := cfg.Logging.ParseLevel()
+	logger, err := logging.New(os.Stderr, cfg.Logging.Format, level)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the packages logging to slog.Default(), or to the standard logger, log
+	// through logger too
+	slog.SetDefault(logger)
+
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
 
-	if dsn == "" {
-		log.Fatal("DSN environment variable not set")
+	// spans are only created when an exporter is configured
+	var tracerProvider *sdktrace.TracerProvider
+
+	if cfg.Tracing.Exporter != "" {
+		exporter, err := telemetry.NewExporter(context.Background(), cfg.Tracing.Exporter, os.Stdout)
+		if err != nil {
+			fatal("Creating the span exporter failed", err)
+		}
+
+		tracerProvider = telemetry.NewTracerProvider(exporter, cfg.Tracing.ServiceName, cfg.Tracing.SampleRatio)
+	}
+
+	cacheOptions := cache.Options{
+		TTL:         cfg.Cache.TTL,
+		NotFoundTTL: cfg.Cache.NotFoundTTL,
+		SearchTTL:   cfg.Cache.SearchTTL,
+		Logger:      logger,
+
+		SearchInvalidationInterval: cfg.Cache.SearchInvalidation,
 	}
 
-	port := os.Getenv("PORT")
+	// people are cached in process, in front of Redis when it is configured so
+	// every instance shares the entries and their invalidations
+	local := cache.NewLRUCache(0, cfg.Cache.LocalBytes)
+	instrument.RegisterCache(registry, "local", local.Stats)
 
-	if port == "" {
-		log.Fatal("PORT environment variable not set")
+	var peopleCache cache.Cache = local
+
+	var client *redis.Client
+
+	if cfg.Cache.RedisAddress != "" {
+		client = redis.NewClient(&redis.Options{
+			Addr: cfg.Cache.RedisAddress,
+		})
+
+		remote := cache.NewRedisCache(client)
+		instrument.RegisterCache(registry, "redis", remote.Stats)
+
+		tiered := cache.NewTieredCache(
+			local,
+			remote,
+			cache.NewRedisBroadcaster(client, cache.InvalidationChannel),
+			cfg.Cache.LocalTTL,
+		)
+		defer tiered.Close()
+
+		peopleCache = tiered
+	} else {
+		logger.Info("No Redis address configured, caching people in process only")
 	}
 
-	redisAddress := os.Getenv("REDIS_ADDRESS")
+	cursorKey := []byte(cfg.CursorSecret)
+
+	if len(cursorKey) == 0 {
+		logger.Warn("No cursor secret configured, pagination tokens will only be valid on this instance")
 
-	if redisAddress == "" {
-		log.Fatal("REDIS_ADDRESS environment variable not set")
+		cursorKey = make([]byte, 32)
+		if _, err := rand.Read(cursorKey); err != nil {
+			fatal("Generating the cursor secret failed", err)
+		}
 	}
 
-	store, err := postgres.NewPostgresStore(dsn)
+	// the backend is picked by the DSN scheme: postgres://, sqlite:// or memory://
+	store, err := persistence.Open(cfg.DSN, persistence.OpenOptions{
+		MaxOpenConns: cfg.Database.MaxOpenConns,
+		MaxIdleConns: cfg.Database.MaxIdleConns,
+	})
 
 	if err != nil {
-		log.Fatal(err)
+		fatal("Opening the store failed", err)
+	}
+
+	// the pool of the SQL backends is exported by the name of their scheme
+	if db, ok := store.(interface{ DB() *sql.DB }); ok {
+		scheme, _, _ := strings.Cut(cfg.DSN, "://")
+		registry.MustRegister(collectors.NewDBStatsCollector(db.DB(), scheme))
+	}
+
+	var traced persistence.Store = store
+	if tracerProvider != nil {
+		traced = tracing.NewStore(store, tracerProvider)
+		peopleCache = tracing.NewCache(peopleCache, tracerProvider)
+	}
+
+	var backend persistence.Store = instrument.NewStore(traced, registry)
+	var cached *cache.Store
+
+	// in write-behind mode people are queued and inserted in batches, the
+	// cache publishes them to every instance right away and Redis holds the
+	// nicknames claimed by every instance
+	var batched *batch.Store
+
+	if cfg.WriteBehind {
+		options := batch.Options{
+			OnDropped: func(p person.Person, err error) {
+				logger.Warn("Dropped person", "uuid", p.UUID, "nickname", p.Nickname, "error", err)
+				cached.Evict(context.Background(), p.UUID)
+			},
+			// the searches cached since the people were queued miss them
+			OnFlushed: func([]person.Person) {
+				cached.InvalidateSearches(context.Background())
+			},
+			Logger: logger,
+		}
+
+		if client != nil {
+			options.Reservations = batch.NewRedisReservations(client)
+		}
+
+		batched = batch.NewStore(backend, options)
+		backend = batched
+	}
+
+	cached = cache.NewStore(backend, peopleCache, cacheOptions)
+
+	options := api.Options{
+		Address:         cfg.ListenAddress,
+		CursorKey:       cursorKey,
+		ReadTimeout:     cfg.Timeouts.Read,
+		WriteTimeout:    cfg.Timeouts.Write,
+		IdleTimeout:     cfg.Timeouts.Idle,
+		ShutdownTimeout: cfg.Timeouts.Shutdown,
+		DrainDelay:      cfg.Timeouts.Drain,
+		CheckTimeout:    cfg.Timeouts.Check,
+		RequestTimeout:  cfg.Timeouts.Request,
+		RouteTimeouts:   cfg.Timeouts.Routes,
+		DefaultPageSize: cfg.Pagination.DefaultPageSize,
+		MaxPageSize:     cfg.Pagination.MaxPageSize,
+		Metrics:         registry,
+
+		Logger:               logger,
+		AccessLogSampleRatio: cfg.Logging.AccessSampleRatio,
+	}
+
+	if tracerProvider != nil {
+		options.TracerProvider = tracerProvider
+	}
+
+	server := api.New(cached, options)
+
+	if client != nil {
+		server.AddCheck(api.Check{
+			Name:    "redis",
+			Timeout: cfg.Timeouts.Check,
+			Probe:   func(ctx context.Context) error { return client.Ping(ctx).Err() },
+		})
+	}
+
+	if batched != nil {
+		server.OnStop(batched.Close)
 	}
 
-	server := api.New(store, "8080", redisAddress)
+	// registered after the queue so it is flushed before the store closes
+	if closer, ok := store.(io.Closer); ok {
+		server.OnStop(closer.Close)
+	}
+
+	// registered last so it exports the spans of the queue flush
+	if tracerProvider != nil {
+		server.OnStop(func() error { return tracerProvider.Shutdown(context.Background()) })
+	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
@@ -47,30 +235,27 @@ func main() {
 
 	g, ctx := errgroup.WithContext(context.Background())
 
-	log.Println("Starting server")
+	logger.Info("Starting server")
 	g.Go(server.Start)
 
 	select {
 	case <-ctx.Done():
 		err = server.Stop()
 		if err != nil {
-			log.Println("Error:", err)
-			os.Exit(1)
+			fatal("Stopping the server failed", err)
 		}
 	case sig := <-interrupt:
-		log.Println("Received signal:", sig)
+		logger.Info("Received signal", "signal", sig.String())
 		err = server.Stop()
 		if err != nil {
-			log.Println("Error:", err)
-			os.Exit(1)
+			fatal("Stopping the server failed", err)
 		}
 	}
 
-	log.Println("Shutting down")
+	logger.Info("Shutting down")
 
 	if err := g.Wait(); err != nil {
-		log.Println("Error:", err)
-		os.Exit(1)
+		fatal("Server failed", err)
 	}
 
 }
@@ -0,0 +1,589 @@
+// Package batch adds people to a store in the background, queueing them and
+// inserting them in batches (write-behind).
+package batch
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/person"
+)
+
+// ErrClosed is returned by the writes queued after Close
+var ErrClosed = errors.New("Store closed")
+
+// Options configures when the queued people are flushed
+type Options struct {
+	// Size is the number of queued people that triggers a flush
+	Size int
+	// Interval is the longest a queued person waits for a flush
+	Interval time.Duration
+	// QueueSize bounds the people waiting to be flushed
+	QueueSize int
+	// EnqueueTimeout is how long AddPerson waits for room in a full queue
+	// before failing with persistence.ErrQueueFull
+	EnqueueTimeout time.Duration
+	// OnDropped is called with the people accepted by AddPerson that the
+	// store rejected when flushed: persistence.ErrNicknameTaken when their
+	// nickname was taken, the error of the store when they failed
+	// MaxAttempts flushes
+	OnDropped func(person.Person, error)
+	// MaxAttempts is the number of failed flushes after which a person the
+	// store keeps rejecting is dropped. Flushes failing while the store does
+	// not answer Ping are not counted.
+	MaxAttempts int
+	// FlushTimeout bounds a flush, including the one of Close
+	FlushTimeout time.Duration
+	// OnFlushed is called with the people a flush added to the store
+	OnFlushed func([]person.Person)
+	// Reservations claims the nicknames across the instances, they are only
+	// checked against the people queued by this one when nil
+	Reservations Reservations
+	// ReservationTTL is how long the nickname of a queued person stays
+	// claimed if its instance stops before flushing it
+	ReservationTTL time.Duration
+	// Logger reports the failed flushes, slog.Default() when nil
+	Logger *slog.Logger
+}
+
+// DefaultOptions are used for the options left zero
+var DefaultOptions = Options{
+	Size:           100,
+	Interval:       50 * time.Millisecond,
+	QueueSize:      1000,
+	EnqueueTimeout: 100 * time.Millisecond,
+	MaxAttempts:    5,
+	FlushTimeout:   5 * time.Second,
+	ReservationTTL: 10 * time.Minute,
+}
+
+func (o Options) withDefaults() Options {
+	if o.Size <= 0 {
+		o.Size = DefaultOptions.Size
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultOptions.Interval
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = DefaultOptions.QueueSize
+	}
+	if o.EnqueueTimeout <= 0 {
+		o.EnqueueTimeout = DefaultOptions.EnqueueTimeout
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultOptions.MaxAttempts
+	}
+	if o.FlushTimeout <= 0 {
+		o.FlushTimeout = DefaultOptions.FlushTimeout
+	}
+	if o.ReservationTTL <= 0 {
+		o.ReservationTTL = DefaultOptions.ReservationTTL
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	return o
+}
+
+// Store queues the people passed to AddPerson and flushes them to the
+// wrapped store with BatchAddPeople. AddPerson returns a zero ID, the ID is
+// assigned when the person is flushed.
+//
+// Queued people are not listed by GetPeople or GetPeopleCount until they are
+// flushed. Reading or writing a queued person by UUID flushes the queue
+// first. Nicknames are checked against the queued people and the
+// Reservations, not the store: a person whose nickname was taken in the store
+// without a reservation, before write-behind or by an import, is dropped when
+// flushed. With Reservations, updating or deleting a person reads it first to
+// move or drop the claim of its nickname.
+type Store struct {
+	persistence.Store
+
+	options Options
+
+	queue   chan person.Person
+	flushes chan chan error
+	stop    chan struct{}
+	done    chan struct{}
+
+	// closeMu guards closed, AddPerson holds it while queueing so Close
+	// never misses a person
+	closeMu sync.RWMutex
+	closed  bool
+	// err is the result of the last flush, read after done is closed
+	err error
+
+	mu        sync.Mutex
+	pending   map[string]struct{}
+	nicknames map[string]struct{}
+
+	// attempts counts the failed flushes of the people in the batch, only
+	// used by run
+	attempts map[string]int
+}
+
+// NewStore wraps store, starting the background flushes until Close is
+// called
+func NewStore(store persistence.Store, options Options) *Store {
+	options = options.withDefaults()
+
+	s := &Store{
+		Store:     store,
+		options:   options,
+		queue:     make(chan person.Person, options.QueueSize),
+		flushes:   make(chan chan error),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		pending:   map[string]struct{}{},
+		nicknames: map[string]struct{}{},
+		attempts:  map[string]int{},
+	}
+
+	go s.run()
+
+	return s
+}
+
+// reserve marks p as queued, it fails if a queued person has the nickname
+func (s *Store) reserve(p person.Person) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.nicknames[p.Nickname]; taken {
+		return false
+	}
+
+	s.pending[p.UUID] = struct{}{}
+	s.nicknames[p.Nickname] = struct{}{}
+
+	return true
+}
+
+func (s *Store) release(people ...person.Person) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range people {
+		delete(s.pending, p.UUID)
+		delete(s.nicknames, p.Nickname)
+	}
+}
+
+func (s *Store) isPending(uuid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.pending[uuid]
+	return ok
+}
+
+func (s *Store) AddPerson(ctx context.Context, p person.Person) (int64, error) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	if !s.reserve(p) {
+		return 0, persistence.ErrNicknameTaken
+	}
+
+	if s.options.Reservations != nil {
+		if err := s.options.Reservations.Reserve(ctx, p.Nickname, s.options.ReservationTTL); err != nil {
+			s.release(p)
+			return 0, err
+		}
+	}
+
+	timeout := time.NewTimer(s.options.EnqueueTimeout)
+	defer timeout.Stop()
+
+	select {
+	case s.queue <- p:
+		return 0, nil
+	case <-timeout.C:
+	case <-ctx.Done():
+	}
+
+	s.release(p)
+	s.unclaim(ctx, p.Nickname)
+
+	return 0, persistence.ErrQueueFull
+}
+
+// claim makes the claims of the nicknames taken in the store permanent
+func (s *Store) claim(ctx context.Context, nicknames ...string) {
+	if s.options.Reservations == nil || len(nicknames) == 0 {
+		return
+	}
+
+	if err := s.options.Reservations.Keep(ctx, nicknames...); err != nil {
+		s.options.Logger.WarnContext(ctx, "Keeping the nickname reservations failed", "count", len(nicknames), "error", err)
+	}
+}
+
+// unclaim drops the claims of the nicknames no person has anymore
+func (s *Store) unclaim(ctx context.Context, nicknames ...string) {
+	if s.options.Reservations == nil || len(nicknames) == 0 {
+		return
+	}
+
+	if err := s.options.Reservations.Release(ctx, nicknames...); err != nil {
+		s.options.Logger.WarnContext(ctx, "Releasing the nickname reservations failed", "count", len(nicknames), "error", err)
+	}
+}
+
+// rename claims the nickname a person is given by a write, returning the
+// func settling the claims once the write returned
+func (s *Store) rename(ctx context.Context, uuid string, nickname string) (func(error), error) {
+	if s.options.Reservations == nil {
+		return func(error) {}, nil
+	}
+
+	current, err := s.Store.GetPerson(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if current.Nickname == nickname {
+		return func(error) {}, nil
+	}
+
+	if err := s.options.Reservations.Reserve(ctx, nickname, s.options.ReservationTTL); err != nil {
+		return nil, err
+	}
+
+	return func(err error) {
+		if err != nil {
+			s.unclaim(ctx, nickname)
+			return
+		}
+
+		s.claim(ctx, nickname)
+		s.unclaim(ctx, current.Nickname)
+	}, nil
+}
+
+// BatchAddPeople flushes the queue and adds the people right away. With
+// Reservations the people whose nickname is claimed get a zero ID, like those
+// whose nickname is taken in the store.
+func (s *Store) BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error) {
+	if err := s.Flush(ctx); err != nil {
+		return nil, err
+	}
+
+	if s.options.Reservations == nil {
+		return s.Store.BatchAddPeople(ctx, people)
+	}
+
+	ids := make([]int64, len(people))
+
+	// the people whose nickname is claimed are left out, index maps the
+	// others to their position in people
+	claimed := make([]person.Person, 0, len(people))
+	index := make([]int, 0, len(people))
+
+	for i, p := range people {
+		err := s.options.Reservations.Reserve(ctx, p.Nickname, s.options.ReservationTTL)
+		if err == persistence.ErrNicknameTaken {
+			continue
+		}
+		if err != nil {
+			s.unclaim(ctx, nicknames(claimed)...)
+			return nil, err
+		}
+
+		claimed = append(claimed, p)
+		index = append(index, i)
+	}
+
+	added, err := s.Store.BatchAddPeople(ctx, claimed)
+	if err != nil {
+		s.unclaim(ctx, nicknames(claimed)...)
+		return nil, err
+	}
+
+	for i, id := range added {
+		ids[index[i]] = id
+	}
+
+	// a person left out by the store has the nickname of one added before
+	// it, or of a person already stored: the nickname is taken either way
+	s.claim(ctx, nicknames(claimed)...)
+
+	return ids, nil
+}
+
+func nicknames(people []person.Person) []string {
+	names := make([]string, 0, len(people))
+	for _, p := range people {
+		names = append(names, p.Nickname)
+	}
+	return names
+}
+
+// IteratePeople flushes the queue so the queued people are included
+func (s *Store) IteratePeople(ctx context.Context, query string) (persistence.PeopleIterator, error) {
+	if err := s.Flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.Store.IteratePeople(ctx, query)
+}
+
+// flushPending flushes the queue if the person is in it
+func (s *Store) flushPending(ctx context.Context, uuid string) error {
+	if !s.isPending(uuid) {
+		return nil
+	}
+
+	return s.Flush(ctx)
+}
+
+func (s *Store) GetPerson(ctx context.Context, uuid string) (*person.Person, error) {
+	if err := s.flushPending(ctx, uuid); err != nil {
+		return nil, err
+	}
+
+	return s.Store.GetPerson(ctx, uuid)
+}
+
+func (s *Store) UpdatePerson(ctx context.Context, p person.Person) error {
+	if err := s.flushPending(ctx, p.UUID); err != nil {
+		return err
+	}
+
+	settle, err := s.rename(ctx, p.UUID, p.Nickname)
+	if err != nil {
+		return err
+	}
+
+	err = s.Store.UpdatePerson(ctx, p)
+	settle(err)
+
+	return err
+}
+
+func (s *Store) PatchPerson(ctx context.Context, uuid string, patch persistence.PersonPatch) (*person.Person, error) {
+	if err := s.flushPending(ctx, uuid); err != nil {
+		return nil, err
+	}
+
+	if patch.Nickname == nil {
+		return s.Store.PatchPerson(ctx, uuid, patch)
+	}
+
+	settle, err := s.rename(ctx, uuid, *patch.Nickname)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := s.Store.PatchPerson(ctx, uuid, patch)
+	settle(err)
+
+	return p, err
+}
+
+func (s *Store) DeletePerson(ctx context.Context, uuid string) error {
+	if err := s.flushPending(ctx, uuid); err != nil {
+		return err
+	}
+
+	if s.options.Reservations == nil {
+		return s.Store.DeletePerson(ctx, uuid)
+	}
+
+	p, err := s.Store.GetPerson(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Store.DeletePerson(ctx, uuid); err != nil {
+		return err
+	}
+
+	s.unclaim(ctx, p.Nickname)
+
+	return nil
+}
+
+// Flush writes every queued person to the wrapped store
+func (s *Store) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+
+	select {
+	case s.flushes <- reply:
+	case <-s.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops queueing people and flushes the queue
+func (s *Store) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		<-s.done
+		return s.err
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	close(s.stop)
+	<-s.done
+
+	return s.err
+}
+
+func (s *Store) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.options.Interval)
+	defer ticker.Stop()
+
+	var batch []person.Person
+
+	for {
+		// while the store fails the batch grows up to the queue size, then
+		// the queue fills and AddPerson applies backpressure
+		queue := s.queue
+		if len(batch) >= s.options.QueueSize {
+			queue = nil
+		}
+
+		select {
+		case p := <-queue:
+			batch = append(batch, p)
+			if len(batch) >= s.options.Size {
+				batch, _ = s.flush(batch)
+			}
+		case <-ticker.C:
+			batch, _ = s.flush(batch)
+		case reply := <-s.flushes:
+			var err error
+			batch, err = s.flush(s.drain(batch))
+			reply <- err
+		case <-s.stop:
+			_, s.err = s.flush(s.drain(batch))
+			return
+		}
+	}
+}
+
+// drain appends the people waiting in the queue to batch
+func (s *Store) drain(batch []person.Person) []person.Person {
+	for {
+		select {
+		case p := <-s.queue:
+			batch = append(batch, p)
+		default:
+			return batch
+		}
+	}
+}
+
+// flush adds batch to the wrapped store and returns what is left to flush.
+// When the batch fails while the store answers, it is split to find the
+// people the store rejects, the others are added. A person failing
+// MaxAttempts flushes is dropped.
+func (s *Store) flush(batch []person.Person) ([]person.Person, error) {
+	if len(batch) == 0 {
+		return batch, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.FlushTimeout)
+	defer cancel()
+
+	left, err := s.add(ctx, batch)
+	if err != nil {
+		s.options.Logger.Error("Flushing people failed", "count", len(batch), "left", len(left), "error", err)
+	}
+
+	return left, err
+}
+
+// add adds people to the wrapped store, returning the people left to flush
+// and the last error of the store
+func (s *Store) add(ctx context.Context, people []person.Person) ([]person.Person, error) {
+	ids, err := s.Store.BatchAddPeople(ctx, people)
+	if err == nil {
+		s.added(ctx, people, ids)
+		return people[:0], nil
+	}
+
+	// the store is down or out of time, every person would fail the same way
+	if ctx.Err() != nil || s.Store.Ping(ctx) != nil {
+		return people, err
+	}
+
+	if len(people) > 1 {
+		half := len(people) / 2
+
+		// the halves are copied, the left people are appended to the first
+		first, firstErr := s.add(ctx, append([]person.Person(nil), people[:half]...))
+		second, secondErr := s.add(ctx, append([]person.Person(nil), people[half:]...))
+
+		if secondErr != nil {
+			firstErr = secondErr
+		}
+		return append(first, second...), firstErr
+	}
+
+	p := people[0]
+
+	s.attempts[p.UUID]++
+	if s.attempts[p.UUID] < s.options.MaxAttempts {
+		return people, err
+	}
+
+	delete(s.attempts, p.UUID)
+	s.release(p)
+	s.unclaim(ctx, p.Nickname)
+
+	s.options.Logger.Warn("Dropped person rejected by the store", "uuid", p.UUID, "attempts", s.options.MaxAttempts, "error", err)
+	if s.options.OnDropped != nil {
+		s.options.OnDropped(p, err)
+	}
+
+	return people[:0], nil
+}
+
+// added releases the people flushed to the wrapped store, reporting those
+// added and those whose nickname was taken. Every nickname is taken in the
+// store now, so their claims are kept.
+func (s *Store) added(ctx context.Context, people []person.Person, ids []int64) {
+	s.release(people...)
+
+	flushed := make([]person.Person, 0, len(people))
+
+	for i, p := range people {
+		delete(s.attempts, p.UUID)
+
+		if ids[i] != 0 {
+			p.ID = int(ids[i])
+			flushed = append(flushed, p)
+		} else if s.options.OnDropped != nil {
+			s.options.OnDropped(p, persistence.ErrNicknameTaken)
+		}
+	}
+
+	s.claim(ctx, nicknames(people)...)
+
+	if len(flushed) > 0 && s.options.OnFlushed != nil {
+		s.options.OnFlushed(flushed)
+	}
+}
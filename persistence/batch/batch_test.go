@@ -0,0 +1,371 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/memory"
+	"rinha-backend-go/person"
+)
+
+// recordingStore records the batches reaching the wrapped store. While fail
+// is set it is down, failing the batches and Ping. It rejects the batches
+// holding the nickname in reject, like a database whose column is too short.
+type recordingStore struct {
+	persistence.Store
+
+	mu      sync.Mutex
+	batches []int
+	fail    bool
+	reject  string
+}
+
+func (s *recordingStore) BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		return nil, errors.New("store down")
+	}
+
+	for _, p := range people {
+		if p.Nickname == s.reject {
+			return nil, errors.New("value too long")
+		}
+	}
+
+	s.batches = append(s.batches, len(people))
+	return s.Store.BatchAddPeople(ctx, people)
+}
+
+func (s *recordingStore) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		return errors.New("store down")
+	}
+	return s.Store.Ping(ctx)
+}
+
+func (s *recordingStore) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *recordingStore) flushed() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.batches...)
+}
+
+func newRecordingStore(t *testing.T) *recordingStore {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+	return &recordingStore{Store: store}
+}
+
+func newPerson(nickname string) person.Person {
+	return person.Person{
+		UUID:      uuid.NewString(),
+		Name:      "John Doe",
+		Nickname:  nickname,
+		Birthdate: time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func count(t *testing.T, store persistence.Store) int64 {
+	count, err := store.GetPeopleCount(context.Background())
+	require.NoError(t, err)
+	return count
+}
+
+func TestFlushesOnSize(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStore(t)
+	store := NewStore(backend, Options{Size: 3, Interval: time.Hour})
+	t.Cleanup(func() { store.Close() })
+
+	for _, nickname := range []string{"a", "b", "c", "d"} {
+		id, err := store.AddPerson(ctx, newPerson(nickname))
+		require.NoError(t, err)
+		require.Zero(t, id)
+	}
+
+	require.Eventually(t, func() bool { return count(t, backend) == 3 }, time.Second, time.Millisecond)
+
+	require.NoError(t, store.Close())
+	require.Equal(t, []int{3, 1}, backend.flushed())
+	require.Equal(t, int64(4), count(t, backend))
+
+	_, err := store.AddPerson(ctx, newPerson("e"))
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestFlushesOnInterval(t *testing.T) {
+	backend := newRecordingStore(t)
+	store := NewStore(backend, Options{Size: 100, Interval: 10 * time.Millisecond})
+	t.Cleanup(func() { store.Close() })
+
+	_, err := store.AddPerson(context.Background(), newPerson("johndoe"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return count(t, backend) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestQueuedPeople(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStore(t)
+	store := NewStore(backend, Options{Size: 100, Interval: time.Hour})
+	t.Cleanup(func() { store.Close() })
+
+	p := newPerson("johndoe")
+	_, err := store.AddPerson(ctx, p)
+	require.NoError(t, err)
+
+	_, err = store.AddPerson(ctx, newPerson("johndoe"))
+	require.Equal(t, persistence.ErrNicknameTaken, err)
+
+	// reading a queued person flushes it first
+	got, err := store.GetPerson(ctx, p.UUID)
+	require.NoError(t, err)
+	require.NotZero(t, got.ID)
+	require.Equal(t, []int{1}, backend.flushed())
+
+	// a nickname taken in the store is only found when flushing
+	var dropped []person.Person
+	store = NewStore(backend, Options{Size: 100, Interval: time.Hour, OnDropped: func(p person.Person, err error) {
+		require.Equal(t, persistence.ErrNicknameTaken, err)
+		dropped = append(dropped, p)
+	}})
+	t.Cleanup(func() { store.Close() })
+
+	duplicate := newPerson("johndoe")
+	_, err = store.AddPerson(ctx, duplicate)
+	require.NoError(t, err)
+
+	_, err = store.GetPerson(ctx, duplicate.UUID)
+	require.Equal(t, persistence.ErrPersonNotFound, err)
+	require.Equal(t, []person.Person{duplicate}, dropped)
+}
+
+func TestBackpressure(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStore(t)
+	backend.setFail(true)
+
+	store := NewStore(backend, Options{Size: 1, Interval: time.Hour, QueueSize: 2, EnqueueTimeout: 10 * time.Millisecond})
+	t.Cleanup(func() { store.Close() })
+
+	// the failing batch holds two people and the queue two more
+	var err error
+	for i := 0; err == nil && i < 10; i++ {
+		_, err = store.AddPerson(ctx, newPerson(uuid.NewString()[:8]))
+	}
+	require.Equal(t, persistence.ErrQueueFull, err)
+
+	require.Error(t, store.Flush(ctx))
+
+	backend.setFail(false)
+	require.NoError(t, store.Flush(ctx))
+	require.Equal(t, int64(4), count(t, backend))
+
+	_, err = store.AddPerson(ctx, newPerson("johndoe"))
+	require.NoError(t, err)
+}
+
+func TestRejectedPerson(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStore(t)
+	backend.reject = "rejected"
+
+	var dropped []person.Person
+	store := NewStore(backend, Options{Size: 100, Interval: time.Hour, MaxAttempts: 2, OnDropped: func(p person.Person, err error) {
+		require.EqualError(t, err, "value too long")
+		dropped = append(dropped, p)
+	}})
+	t.Cleanup(func() { store.Close() })
+
+	rejected := newPerson("rejected")
+	for _, p := range []person.Person{newPerson("a"), rejected, newPerson("b"), newPerson("c")} {
+		_, err := store.AddPerson(ctx, p)
+		require.NoError(t, err)
+	}
+
+	// the batch is split, the others are added and the rejected person is
+	// retried until it is dropped
+	require.Error(t, store.Flush(ctx))
+	require.Equal(t, int64(3), count(t, backend))
+	require.Empty(t, dropped)
+
+	require.NoError(t, store.Flush(ctx))
+	require.Equal(t, []person.Person{rejected}, dropped)
+
+	// the queue flows again, and the nickname can be queued again
+	_, err := store.GetPerson(ctx, rejected.UUID)
+	require.Equal(t, persistence.ErrPersonNotFound, err)
+
+	_, err = store.AddPerson(ctx, newPerson("rejected"))
+	require.NoError(t, err)
+}
+
+// stuckStore never answers a batch until the context of the call is done
+type stuckStore struct {
+	persistence.Store
+}
+
+func (stuckStore) BatchAddPeople(ctx context.Context, _ []person.Person) ([]int64, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCloseStuckStore(t *testing.T) {
+	store := NewStore(stuckStore{newRecordingStore(t)}, Options{Size: 100, Interval: time.Hour, FlushTimeout: 10 * time.Millisecond})
+
+	_, err := store.AddPerson(context.Background(), newPerson("johndoe"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.ErrorIs(t, store.Close(), context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+// memoryReservations shares claims between the stores of a test like Redis
+// does between instances
+type memoryReservations struct {
+	mu      sync.Mutex
+	claimed map[string]bool
+}
+
+func (r *memoryReservations) Reserve(_ context.Context, nickname string, _ time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.claimed[nickname]; ok {
+		return persistence.ErrNicknameTaken
+	}
+	r.claimed[nickname] = false
+	return nil
+}
+
+func (r *memoryReservations) Keep(_ context.Context, nicknames ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, nickname := range nicknames {
+		if _, ok := r.claimed[nickname]; ok {
+			r.claimed[nickname] = true
+		}
+	}
+	return nil
+}
+
+func (r *memoryReservations) Release(_ context.Context, nicknames ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, nickname := range nicknames {
+		delete(r.claimed, nickname)
+	}
+	return nil
+}
+
+func (r *memoryReservations) kept(nickname string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.claimed[nickname]
+}
+
+func TestReservations(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStore(t)
+	reservations := &memoryReservations{claimed: map[string]bool{}}
+
+	// two instances queueing people into one store
+	options := Options{Size: 100, Interval: time.Hour, Reservations: reservations}
+	two := NewStore(backend, options)
+	t.Cleanup(func() { two.Close() })
+
+	var flushed []person.Person
+	options.OnFlushed = func(people []person.Person) {
+		flushed = append(flushed, people...)
+	}
+	one := NewStore(backend, options)
+	t.Cleanup(func() { one.Close() })
+
+	john := newPerson("johndoe")
+	_, err := one.AddPerson(ctx, john)
+	require.NoError(t, err)
+
+	_, err = two.AddPerson(ctx, newPerson("johndoe"))
+	require.Equal(t, persistence.ErrNicknameTaken, err)
+
+	// the claim is kept once the person is added
+	require.NoError(t, one.Flush(ctx))
+	require.Len(t, flushed, 1)
+	require.Equal(t, john.UUID, flushed[0].UUID)
+	require.NotZero(t, flushed[0].ID)
+	require.True(t, reservations.kept("johndoe"))
+
+	_, err = two.AddPerson(ctx, newPerson("johndoe"))
+	require.Equal(t, persistence.ErrNicknameTaken, err)
+
+	// a batch skips the claimed nicknames
+	ids, err := two.BatchAddPeople(ctx, []person.Person{newPerson("johndoe"), newPerson("janedoe")})
+	require.NoError(t, err)
+	require.Zero(t, ids[0])
+	require.NotZero(t, ids[1])
+	require.True(t, reservations.kept("janedoe"))
+
+	// renaming moves the claim
+	john.Nickname = "johnsmith"
+	require.NoError(t, two.UpdatePerson(ctx, john))
+	require.True(t, reservations.kept("johnsmith"))
+
+	_, err = one.AddPerson(ctx, newPerson("johndoe"))
+	require.NoError(t, err)
+
+	// deleting drops it
+	require.NoError(t, two.DeletePerson(ctx, john.UUID))
+
+	_, err = one.AddPerson(ctx, newPerson("johnsmith"))
+	require.NoError(t, err)
+}
+
+// TestRedisReservations runs against the Redis server in REDIS_TEST_ADDRESS
+func TestRedisReservations(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_ADDRESS")
+
+	if address == "" {
+		t.Skip("REDIS_TEST_ADDRESS not set")
+	}
+
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: address})
+	t.Cleanup(func() { client.Close() })
+
+	r := NewRedisReservations(client)
+	nickname := "test-" + uuid.NewString()
+	t.Cleanup(func() { r.Release(ctx, nickname) })
+
+	require.NoError(t, r.Reserve(ctx, nickname, time.Minute))
+	require.Equal(t, persistence.ErrNicknameTaken, r.Reserve(ctx, nickname, time.Minute))
+
+	require.NoError(t, r.Keep(ctx, nickname))
+	ttl, err := client.TTL(ctx, ReservationPrefix+nickname).Result()
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(-1), ttl)
+
+	require.NoError(t, r.Release(ctx, nickname))
+	require.NoError(t, r.Reserve(ctx, nickname, time.Minute))
+}
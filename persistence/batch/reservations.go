@@ -0,0 +1,76 @@
+package batch
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"rinha-backend-go/persistence"
+)
+
+// Reservations claims the nicknames of the queued people where every
+// instance sees them, so two instances never both accept one. A claim is
+// kept once the person is added, the nickname is then taken in the store.
+type Reservations interface {
+	// Reserve claims the nickname for ttl, it fails with
+	// persistence.ErrNicknameTaken when it is claimed already
+	Reserve(ctx context.Context, nickname string, ttl time.Duration) error
+	// Keep makes the claims of the nicknames taken in the store permanent
+	Keep(ctx context.Context, nicknames ...string) error
+	// Release drops the claims of the nicknames
+	Release(ctx context.Context, nicknames ...string) error
+}
+
+// ReservationPrefix prefixes the Redis keys of the claimed nicknames
+const ReservationPrefix = "nickname:"
+
+// RedisReservations claims the nicknames with SET NX in Redis
+type RedisReservations struct {
+	client *redis.Client
+}
+
+func NewRedisReservations(client *redis.Client) *RedisReservations {
+	return &RedisReservations{client: client}
+}
+
+func (r *RedisReservations) Reserve(ctx context.Context, nickname string, ttl time.Duration) error {
+	claimed, err := r.client.SetNX(ctx, ReservationPrefix+nickname, 1, ttl).Result()
+	if err != nil {
+		return err
+	}
+
+	if !claimed {
+		return persistence.ErrNicknameTaken
+	}
+
+	return nil
+}
+
+func (r *RedisReservations) Keep(ctx context.Context, nicknames ...string) error {
+	if len(nicknames) == 0 {
+		return nil
+	}
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, nickname := range nicknames {
+			pipe.Persist(ctx, ReservationPrefix+nickname)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (r *RedisReservations) Release(ctx context.Context, nicknames ...string) error {
+	if len(nicknames) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(nicknames))
+	for _, nickname := range nicknames {
+		keys = append(keys, ReservationPrefix+nickname)
+	}
+
+	return r.client.Del(ctx, keys...).Err()
+}
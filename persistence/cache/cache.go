@@ -0,0 +1,353 @@
+// Package cache adds read-through/write-through caching of people to any
+// persistence.Store.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/person"
+)
+
+// ErrMiss is returned by Cache.Get when the key is not cached
+var ErrMiss = errors.New("Cache miss")
+
+// Cache is a key-value cache. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the cached value or ErrMiss
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set caches the value, a zero ttl caches it until it is evicted
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Filler is implemented by the caches telling a fill from a write. A fill
+// caches a value read from the store, unlike a write it replaces nothing the
+// other instances must drop.
+type Filler interface {
+	Fill(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// Fill caches a value read from the store, with the Fill of c when it has one
+func Fill(ctx context.Context, c Cache, key string, value []byte, ttl time.Duration) error {
+	if filler, ok := c.(Filler); ok {
+		return filler.Fill(ctx, key, value, ttl)
+	}
+	return c.Set(ctx, key, value, ttl)
+}
+
+// Stats counts the lookups answered by a cache and the operations that
+// failed
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	Errors uint64
+}
+
+// counters tracks the Stats of a cache, it is safe for concurrent use
+type counters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	errors atomic.Uint64
+}
+
+func (c *counters) hit()  { c.hits.Add(1) }
+func (c *counters) miss() { c.misses.Add(1) }
+
+// fail counts err if it is not nil and returns it
+func (c *counters) fail(err error) error {
+	if err != nil {
+		c.errors.Add(1)
+	}
+	return err
+}
+
+// Stats returns the operations counted so far
+func (c *counters) Stats() Stats {
+	return Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Errors: c.errors.Load()}
+}
+
+// record is the cached representation of a person, person.Person hides the
+// ID and creation time from its JSON form
+type record struct {
+	ID        int       `json:"id"`
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Nickname  string    `json:"nickname"`
+	Birthdate time.Time `json:"birthdate"`
+	Stack     []string  `json:"stack"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// notFound is cached for the people the store does not have, a person is
+// never encoded to it
+var notFound = []byte("-")
+
+func personKey(uuid string) string {
+	return "person:" + uuid
+}
+
+func newRecord(p *person.Person) record {
+	return record{
+		ID:        p.ID,
+		UUID:      p.UUID,
+		Name:      p.Name,
+		Nickname:  p.Nickname,
+		Birthdate: p.Birthdate,
+		Stack:     p.Stack,
+		CreatedAt: p.CreatedAt,
+	}
+}
+
+func (r record) person() *person.Person {
+	return &person.Person{
+		ID:        r.ID,
+		UUID:      r.UUID,
+		Name:      r.Name,
+		Nickname:  r.Nickname,
+		Birthdate: r.Birthdate,
+		Stack:     r.Stack,
+		CreatedAt: r.CreatedAt,
+	}
+}
+
+func encodePerson(p *person.Person) ([]byte, error) {
+	return json.Marshal(newRecord(p))
+}
+
+func decodePerson(data []byte) (*person.Person, error) {
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	return r.person(), nil
+}
+
+// Options configures what a Store caches and for how long
+type Options struct {
+	// TTL is how long people are cached, zero caches them until evicted
+	TTL time.Duration
+	// NotFoundTTL is how long a lookup of an unknown person is remembered,
+	// zero disables it
+	NotFoundTTL time.Duration
+	// SearchTTL is how long GetPeople results are cached, zero disables it
+	SearchTTL time.Duration
+	// SearchInvalidationInterval bounds how often the writes drop the cached
+	// results. The writes made in the interval after one are applied together
+	// when it ends, zero drops them on every write.
+	SearchInvalidationInterval time.Duration
+	// Logger reports the cache failures the Store carries on without,
+	// slog.Default() when nil
+	Logger *slog.Logger
+}
+
+// Store caches the people read from and written to the wrapped store, keyed
+// by UUID, and the GetPeople results. The cache is best effort: when it fails
+// the store is used as if nothing was cached.
+type Store struct {
+	persistence.Store
+
+	cache   Cache
+	options Options
+
+	// invalidated is when the last search generation was started, a write
+	// within SearchInvalidationInterval of it schedules the next one
+	invalidationMu sync.Mutex
+	invalidated    time.Time
+	scheduled      bool
+}
+
+// NewStore wraps store with cache
+func NewStore(store persistence.Store, cache Cache, options Options) *Store {
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+
+	return &Store{Store: store, cache: loggedCache{Cache: cache, logger: options.Logger}, options: options}
+}
+
+// loggedCache logs the failures of a cache, a miss is not one
+type loggedCache struct {
+	Cache
+	logger *slog.Logger
+}
+
+func (c loggedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.Cache.Get(ctx, key)
+	if err != nil && err != ErrMiss {
+		c.logger.WarnContext(ctx, "Cache get failed", "key", key, "error", err)
+	}
+	return value, err
+}
+
+func (c loggedCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := c.Cache.Set(ctx, key, value, ttl)
+	if err != nil {
+		c.logger.WarnContext(ctx, "Cache set failed", "key", key, "error", err)
+	}
+	return err
+}
+
+func (c loggedCache) Fill(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := Fill(ctx, c.Cache, key, value, ttl)
+	if err != nil {
+		c.logger.WarnContext(ctx, "Cache fill failed", "key", key, "error", err)
+	}
+	return err
+}
+
+func (c loggedCache) Delete(ctx context.Context, keys ...string) error {
+	err := c.Cache.Delete(ctx, keys...)
+	if err != nil {
+		c.logger.WarnContext(ctx, "Cache delete failed", "keys", keys, "error", err)
+	}
+	return err
+}
+
+// changed reports whether a write that returned err may have changed the
+// store
+func changed(err error) bool {
+	return err != persistence.ErrPersonNotFound && err != persistence.ErrNicknameTaken
+}
+
+func (s *Store) set(ctx context.Context, p *person.Person) {
+	data, err := encodePerson(p)
+	if err != nil {
+		return
+	}
+
+	_ = s.cache.Set(ctx, personKey(p.UUID), data, s.options.TTL)
+}
+
+func (s *Store) AddPerson(ctx context.Context, p person.Person) (int64, error) {
+	id, err := s.Store.AddPerson(ctx, p)
+	if changed(err) {
+		s.invalidateSearches(ctx)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	// the store does not return its creation time, the one cached is taken
+	// right after the insert
+	p.ID = int(id)
+	p.CreatedAt = time.Now().UTC()
+	s.set(ctx, &p)
+
+	return id, nil
+}
+
+func (s *Store) BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error) {
+	ids, err := s.Store.BatchAddPeople(ctx, people)
+
+	s.invalidateSearches(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Now().UTC()
+
+	for i, p := range people {
+		if ids[i] == 0 {
+			continue
+		}
+
+		p.ID = int(ids[i])
+		p.CreatedAt = createdAt
+		s.set(ctx, &p)
+	}
+
+	return ids, nil
+}
+
+// Evict drops the cached person, for people removed from the wrapped store
+// without going through the Store
+func (s *Store) Evict(ctx context.Context, uuid string) {
+	_ = s.cache.Delete(ctx, personKey(uuid))
+}
+
+// InvalidateSearches drops the cached search results, for people added to the
+// wrapped store without going through the Store
+func (s *Store) InvalidateSearches(ctx context.Context) {
+	s.invalidateSearches(ctx)
+}
+
+func (s *Store) GetPerson(ctx context.Context, uuid string) (*person.Person, error) {
+	if data, err := s.cache.Get(ctx, personKey(uuid)); err == nil {
+		if bytes.Equal(data, notFound) {
+			return nil, persistence.ErrPersonNotFound
+		}
+
+		if p, err := decodePerson(data); err == nil {
+			return p, nil
+		}
+	}
+
+	p, err := s.Store.GetPerson(ctx, uuid)
+	if err == persistence.ErrPersonNotFound && s.options.NotFoundTTL > 0 {
+		_ = Fill(ctx, s.cache, personKey(uuid), notFound, s.options.NotFoundTTL)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := encodePerson(p); err == nil {
+		_ = Fill(ctx, s.cache, personKey(p.UUID), data, s.options.TTL)
+	}
+
+	return p, nil
+}
+
+func (s *Store) UpdatePerson(ctx context.Context, p person.Person) error {
+	err := s.Store.UpdatePerson(ctx, p)
+
+	// the cached person is dropped even on failure, the update may have been
+	// applied before the error
+	_ = s.cache.Delete(ctx, personKey(p.UUID))
+
+	if changed(err) {
+		s.invalidateSearches(ctx)
+	}
+
+	return err
+}
+
+func (s *Store) PatchPerson(ctx context.Context, uuid string, patch persistence.PersonPatch) (*person.Person, error) {
+	p, err := s.Store.PatchPerson(ctx, uuid, patch)
+	if changed(err) {
+		s.invalidateSearches(ctx)
+	}
+
+	if err != nil {
+		_ = s.cache.Delete(ctx, personKey(uuid))
+		return nil, err
+	}
+
+	s.set(ctx, p)
+
+	return p, nil
+}
+
+func (s *Store) DeletePerson(ctx context.Context, uuid string) error {
+	err := s.Store.DeletePerson(ctx, uuid)
+
+	_ = s.cache.Delete(ctx, personKey(uuid))
+
+	if changed(err) {
+		s.invalidateSearches(ctx)
+	}
+
+	return err
+}
@@ -0,0 +1,491 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cursor"
+	"rinha-backend-go/persistence/memory"
+	"rinha-backend-go/persistence/storetest"
+	"rinha-backend-go/person"
+)
+
+// countingStore counts the GetPerson and GetPeople calls reaching the
+// wrapped store
+type countingStore struct {
+	persistence.Store
+	gets     atomic.Int64
+	searches atomic.Int64
+}
+
+func (s *countingStore) GetPeople(ctx context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
+	s.searches.Add(1)
+	return s.Store.GetPeople(ctx, options)
+}
+
+func (s *countingStore) GetPerson(ctx context.Context, uuid string) (*person.Person, error) {
+	s.gets.Add(1)
+	return s.Store.GetPerson(ctx, uuid)
+}
+
+func newCountingStore(t *testing.T) *countingStore {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+	return &countingStore{Store: store}
+}
+
+func newPerson(nickname string) person.Person {
+	return person.Person{
+		UUID:      uuid.NewString(),
+		Name:      "John Doe",
+		Nickname:  nickname,
+		Birthdate: time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC),
+		Stack:     []string{"Go"},
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	caches := map[string]func() Cache{
+		"lru": func() Cache { return NewLRUCache(100, 0) },
+		"nop": func() Cache { return NopCache{} },
+	}
+
+	for name, newCache := range caches {
+		t.Run(name, func(t *testing.T) {
+			storetest.RunStoreConformance(t, func(t *testing.T) persistence.Store {
+				return NewStore(newCountingStore(t), newCache(), Options{TTL: time.Minute, NotFoundTTL: time.Minute, SearchTTL: time.Minute})
+			})
+		})
+	}
+}
+
+func TestReadThroughAndInvalidation(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStore(t)
+	store := NewStore(backend, NewLRUCache(100, 0), Options{})
+
+	p := newPerson("johndoe")
+	_, err := store.AddPerson(ctx, p)
+	require.NoError(t, err)
+
+	// written through on add
+	got, err := store.GetPerson(ctx, p.UUID)
+	require.NoError(t, err)
+	require.Equal(t, "johndoe", got.Nickname)
+	require.NotZero(t, got.ID)
+	require.Equal(t, int64(0), backend.gets.Load())
+
+	p.Nickname = "janedoe"
+	require.NoError(t, store.UpdatePerson(ctx, p))
+
+	// the update dropped the cached person, the next read goes to the store
+	got, err = store.GetPerson(ctx, p.UUID)
+	require.NoError(t, err)
+	require.Equal(t, "janedoe", got.Nickname)
+	require.Equal(t, int64(1), backend.gets.Load())
+
+	_, err = store.GetPerson(ctx, p.UUID)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), backend.gets.Load())
+
+	require.NoError(t, store.DeletePerson(ctx, p.UUID))
+
+	_, err = store.GetPerson(ctx, p.UUID)
+	require.Equal(t, persistence.ErrPersonNotFound, err)
+}
+
+func TestNotFoundCaching(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStore(t)
+	store := NewStore(backend, NewLRUCache(100, 0), Options{NotFoundTTL: time.Minute})
+
+	p := newPerson("johndoe")
+
+	for i := 0; i < 3; i++ {
+		_, err := store.GetPerson(ctx, p.UUID)
+		require.Equal(t, persistence.ErrPersonNotFound, err)
+	}
+	require.Equal(t, int64(1), backend.gets.Load())
+
+	// a person added behind the cache stays hidden until the entry expires
+	_, err := backend.AddPerson(ctx, p)
+	require.NoError(t, err)
+	_, err = store.GetPerson(ctx, p.UUID)
+	require.Equal(t, persistence.ErrPersonNotFound, err)
+
+	// adding through the cache replaces the negative entry
+	p.UUID = uuid.NewString()
+	_, err = store.GetPerson(ctx, p.UUID)
+	require.Equal(t, persistence.ErrPersonNotFound, err)
+
+	p.Nickname = "janedoe"
+	_, err = store.AddPerson(ctx, p)
+	require.NoError(t, err)
+
+	got, err := store.GetPerson(ctx, p.UUID)
+	require.NoError(t, err)
+	require.Equal(t, "janedoe", got.Nickname)
+
+	// without a notFoundTTL every lookup reaches the store
+	store = NewStore(backend, NewLRUCache(100, 0), Options{})
+	before := backend.gets.Load()
+	for i := 0; i < 3; i++ {
+		_, err := store.GetPerson(ctx, uuid.NewString())
+		require.Equal(t, persistence.ErrPersonNotFound, err)
+	}
+	require.Equal(t, before+3, backend.gets.Load())
+}
+
+func TestSearchCaching(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStore(t)
+	store := NewStore(backend, NewLRUCache(100, 0), Options{SearchTTL: time.Minute})
+
+	john := newPerson("johndoe")
+	_, err := store.AddPerson(ctx, john)
+	require.NoError(t, err)
+
+	search := func(options *persistence.GetPeopleOptions) person.People {
+		people, err := store.GetPeople(ctx, options)
+		require.NoError(t, err)
+		return people
+	}
+
+	people := search(&persistence.GetPeopleOptions{SearchQuery: "Doe"})
+	require.Len(t, people, 1)
+	require.NotZero(t, people[0].ID)
+	require.False(t, people[0].CreatedAt.IsZero())
+
+	// the term is normalized like the stores match it
+	search(&persistence.GetPeopleOptions{SearchQuery: "doe"})
+	require.Equal(t, int64(1), backend.searches.Load())
+
+	// another page size or cursor is another result
+	search(&persistence.GetPeopleOptions{SearchQuery: "doe", PageSize: 2})
+	c := cursor.FromPerson(people[0])
+	require.Empty(t, search(&persistence.GetPeopleOptions{SearchQuery: "doe", After: &c}))
+	require.Equal(t, int64(3), backend.searches.Load())
+
+	// a new person may match, the cached results are dropped
+	_, err = store.AddPerson(ctx, newPerson("janedoe"))
+	require.NoError(t, err)
+
+	require.Len(t, search(&persistence.GetPeopleOptions{SearchQuery: "doe"}), 2)
+	require.Equal(t, int64(4), backend.searches.Load())
+
+	// so are they after an update
+	john.Name = "John Smith"
+	john.Nickname = "johnsmith"
+	require.NoError(t, store.UpdatePerson(ctx, john))
+
+	require.Len(t, search(&persistence.GetPeopleOptions{SearchQuery: "doe"}), 1)
+	require.Equal(t, int64(5), backend.searches.Load())
+
+	// a rejected write changes nothing
+	_, err = store.AddPerson(ctx, newPerson("janedoe"))
+	require.Equal(t, persistence.ErrNicknameTaken, err)
+
+	search(&persistence.GetPeopleOptions{SearchQuery: "doe"})
+	require.Equal(t, int64(5), backend.searches.Load())
+}
+
+func TestSearchInvalidationInterval(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStore(t)
+	store := NewStore(backend, NewLRUCache(100, 0), Options{SearchTTL: time.Minute, SearchInvalidationInterval: 50 * time.Millisecond})
+
+	search := func() int {
+		people, err := store.GetPeople(ctx, &persistence.GetPeopleOptions{SearchQuery: "doe"})
+		require.NoError(t, err)
+		return len(people)
+	}
+
+	// the first write drops the results right away
+	_, err := store.AddPerson(ctx, newPerson("johndoe"))
+	require.NoError(t, err)
+	require.Equal(t, 1, search())
+
+	// the next ones in the interval are applied together when it ends
+	for _, nickname := range []string{"janedoe", "jimdoe"} {
+		_, err = store.AddPerson(ctx, newPerson(nickname))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 1, search())
+	require.Eventually(t, func() bool { return search() == 3 }, time.Second, 5*time.Millisecond)
+}
+
+// failingCache fails every operation, like an unreachable Redis
+type failingCache struct{}
+
+func (failingCache) Get(context.Context, string) ([]byte, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingCache) Set(context.Context, string, []byte, time.Duration) error {
+	return errors.New("connection refused")
+}
+
+func (failingCache) Delete(context.Context, ...string) error {
+	return errors.New("connection refused")
+}
+
+func TestCacheFailures(t *testing.T) {
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, nil))
+
+	store := NewStore(newCountingStore(t), failingCache{}, Options{SearchTTL: time.Minute, Logger: logger})
+
+	p := newPerson("johndoe")
+	_, err := store.AddPerson(ctx, p)
+	require.NoError(t, err)
+
+	// the store is used as if nothing was cached
+	got, err := store.GetPerson(ctx, p.UUID)
+	require.NoError(t, err)
+	require.Equal(t, p.Nickname, got.Nickname)
+
+	require.Contains(t, out.String(), `msg="Cache get failed" key=person:`+p.UUID+` error="connection refused"`)
+	require.Contains(t, out.String(), `msg="Cache set failed" key=people:generation`)
+
+	// a miss is not a failure
+	out.Reset()
+	store = NewStore(newCountingStore(t), NewLRUCache(100, 0), Options{Logger: logger})
+	_, err = store.GetPerson(ctx, p.UUID)
+	require.Equal(t, persistence.ErrPersonNotFound, err)
+	require.Empty(t, out.String())
+}
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRUCache(2, 0)
+
+	require.NoError(t, c.Set(ctx, "a", []byte("1"), 0))
+	require.NoError(t, c.Set(ctx, "b", []byte("2"), 0))
+
+	// reading a makes b the least recently used entry
+	value, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+
+	require.NoError(t, c.Set(ctx, "c", []byte("3"), 0))
+	require.Equal(t, 2, c.Len())
+
+	_, err = c.Get(ctx, "b")
+	require.Equal(t, ErrMiss, err)
+
+	require.NoError(t, c.Delete(ctx, "a", "missing"))
+	_, err = c.Get(ctx, "a")
+	require.Equal(t, ErrMiss, err)
+
+	require.NoError(t, c.Set(ctx, "d", []byte("4"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, err = c.Get(ctx, "d")
+	require.Equal(t, ErrMiss, err)
+}
+
+func TestLRUCacheByteLimit(t *testing.T) {
+	ctx := context.Background()
+	value := make([]byte, 100)
+	entry := int64(len("a") + len(value) + entryOverhead)
+	c := NewLRUCache(0, 2*entry)
+
+	require.NoError(t, c.Set(ctx, "a", value, 0))
+	require.NoError(t, c.Set(ctx, "b", value, 0))
+	require.Equal(t, 2*entry, c.Bytes())
+
+	require.NoError(t, c.Set(ctx, "c", value, 0))
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, 2*entry, c.Bytes())
+
+	_, err := c.Get(ctx, "a")
+	require.Equal(t, ErrMiss, err)
+
+	// a value larger than the whole cache is not cached and evicts nothing
+	require.NoError(t, c.Set(ctx, "d", make([]byte, 3*entry), 0))
+	require.Equal(t, 2, c.Len())
+
+	require.Equal(t, Stats{Hits: 0, Misses: 1}, c.Stats())
+}
+
+// hub is an in-process Broadcaster connecting the caches of a test
+type hub struct {
+	mu          sync.Mutex
+	subscribers map[*hubBroadcaster]func([]string)
+	published   int
+}
+
+type hubBroadcaster struct {
+	hub *hub
+}
+
+func (h *hub) broadcaster() *hubBroadcaster {
+	return &hubBroadcaster{hub: h}
+}
+
+func (b *hubBroadcaster) Publish(_ context.Context, keys ...string) error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+
+	b.hub.published++
+
+	for subscriber, invalidate := range b.hub.subscribers {
+		if subscriber != b {
+			invalidate(keys)
+		}
+	}
+
+	return nil
+}
+
+func (b *hubBroadcaster) Subscribe(ctx context.Context, ready func(), invalidate func([]string)) error {
+	b.hub.mu.Lock()
+	b.hub.subscribers[b] = invalidate
+	b.hub.mu.Unlock()
+
+	ready()
+	<-ctx.Done()
+
+	b.hub.mu.Lock()
+	delete(b.hub.subscribers, b)
+	b.hub.mu.Unlock()
+
+	return nil
+}
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+	remote := NewLRUCache(0, 0)
+	h := &hub{subscribers: map[*hubBroadcaster]func([]string){}}
+
+	one := NewTieredCache(NewLRUCache(0, 1<<20), remote, h.broadcaster(), time.Minute)
+	t.Cleanup(func() { one.Close() })
+	two := NewTieredCache(NewLRUCache(0, 1<<20), remote, h.broadcaster(), time.Minute)
+	t.Cleanup(func() { two.Close() })
+
+	require.Eventually(t, func() bool {
+		return one.subscribed.Load() && two.subscribed.Load()
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, one.Set(ctx, "key", []byte("v1"), 0))
+
+	// the first read on two comes from the remote tier, the second is local
+	for i := 0; i < 2; i++ {
+		value, err := two.Get(ctx, "key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("v1"), value)
+	}
+	require.Equal(t, TierStats{Local: Stats{Hits: 1, Misses: 1}, Remote: Stats{Hits: 1}}, two.Stats())
+
+	// writing on one drops the local copy of two
+	require.NoError(t, one.Set(ctx, "key", []byte("v2"), 0))
+
+	value, err := two.Get(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+
+	require.NoError(t, one.Delete(ctx, "key"))
+
+	_, err = two.Get(ctx, "key")
+	require.Equal(t, ErrMiss, err)
+	require.Equal(t, uint64(1), two.Stats().Remote.Misses)
+
+	// a fill is cached in both tiers but not broadcast
+	h.mu.Lock()
+	published := h.published
+	h.mu.Unlock()
+
+	require.NoError(t, Fill(ctx, one, "filled", []byte("v1"), 0))
+
+	value, err = remote.Get(ctx, "filled")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), value)
+
+	value, err = one.local.Get(ctx, "filled")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), value)
+
+	h.mu.Lock()
+	require.Equal(t, published, h.published)
+	h.mu.Unlock()
+}
+
+// TestRedisCache runs against the Redis server in REDIS_TEST_ADDRESS
+func TestRedisCache(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_ADDRESS")
+
+	if address == "" {
+		t.Skip("REDIS_TEST_ADDRESS not set")
+	}
+
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: address})
+	t.Cleanup(func() { client.Close() })
+
+	c := NewRedisCache(client)
+	key := "test:" + uuid.NewString()
+
+	_, err := c.Get(ctx, key)
+	require.Equal(t, ErrMiss, err)
+
+	require.NoError(t, c.Set(ctx, key, []byte("value"), time.Minute))
+
+	value, err := c.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	require.NoError(t, c.Delete(ctx, key))
+
+	_, err = c.Get(ctx, key)
+	require.Equal(t, ErrMiss, err)
+	require.Equal(t, Stats{Hits: 1, Misses: 2}, c.Stats())
+}
+
+// TestRedisBroadcaster runs against the Redis server in REDIS_TEST_ADDRESS
+func TestRedisBroadcaster(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_ADDRESS")
+
+	if address == "" {
+		t.Skip("REDIS_TEST_ADDRESS not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	client := redis.NewClient(&redis.Options{Addr: address})
+	t.Cleanup(func() { client.Close() })
+
+	channel := "test:" + uuid.NewString()
+	one := NewRedisBroadcaster(client, channel)
+	two := NewRedisBroadcaster(client, channel)
+
+	ready := make(chan struct{})
+	received := make(chan []string, 2)
+	go two.Subscribe(ctx, func() { close(ready) }, func(keys []string) { received <- keys })
+	<-ready
+
+	// two skips its own message
+	require.NoError(t, two.Publish(ctx, "ignored"))
+	require.NoError(t, one.Publish(ctx, "a", "b"))
+
+	select {
+	case keys := <-received:
+		require.Equal(t, []string{"a", "b"}, keys)
+	case <-time.After(time.Second):
+		t.Fatal("invalidation not received")
+	}
+}
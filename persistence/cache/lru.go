@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// entryOverhead approximates the memory used by an entry besides its key and
+// value: the list element, the map bucket slot and the entry itself
+const entryOverhead = 128
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *lruEntry) size() int64 {
+	return int64(len(e.key) + len(e.value) + entryOverhead)
+}
+
+// LRUCache is an in-process cache bounded by a number of entries and by the
+// approximate memory they use, evicting the least recently used entries when
+// either limit is exceeded
+type LRUCache struct {
+	counters
+
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	entries    map[string]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+}
+
+// NewLRUCache creates a cache holding up to maxEntries entries using up to
+// maxBytes bytes, a zero limit is not enforced
+func NewLRUCache(maxEntries int, maxBytes int64) *LRUCache {
+	return &LRUCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+func (c *LRUCache) Get(_ context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.miss()
+		return nil, ErrMiss
+	}
+
+	entry := element.Value.(*lruEntry)
+
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		c.miss()
+		return nil, ErrMiss
+	}
+
+	c.order.MoveToFront(element)
+	c.hit()
+
+	return entry.value, nil
+}
+
+func (c *LRUCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lruEntry{key: key, value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	// an entry that can never fit would evict everything else
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return nil
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += entry.size()
+
+	for (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.order.Back())
+	}
+
+	return nil
+}
+
+func (c *LRUCache) Delete(_ context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+	}
+
+	return nil
+}
+
+// Clear drops every entry
+func (c *LRUCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+	c.bytes = 0
+}
+
+// Len returns the number of cached entries, including expired ones not yet
+// evicted
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Bytes returns the approximate memory used by the cached entries
+func (c *LRUCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.bytes
+}
+
+// remove drops the entry, the caller must hold the lock
+func (c *LRUCache) remove(element *list.Element) {
+	entry := element.Value.(*lruEntry)
+
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
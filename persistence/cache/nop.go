@@ -0,0 +1,21 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// NopCache caches nothing, every Get is a miss
+type NopCache struct{}
+
+func (NopCache) Get(context.Context, string) ([]byte, error) {
+	return nil, ErrMiss
+}
+
+func (NopCache) Set(context.Context, string, []byte, time.Duration) error {
+	return nil
+}
+
+func (NopCache) Delete(context.Context, ...string) error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// InvalidationChannel is the Redis pub/sub channel the invalidated keys are
+// broadcast on
+const InvalidationChannel = "people:invalidate"
+
+// RedisCache stores the entries in Redis, so they are shared by every API
+// instance
+type RedisCache struct {
+	counters
+
+	client *redis.Client
+}
+
+func NewRedisCache(client *redis.Client) *RedisCache {
+	return &RedisCache{client: client}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		c.miss()
+		return nil, ErrMiss
+	}
+
+	if err == nil {
+		c.hit()
+	}
+
+	return value, c.fail(err)
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.fail(c.client.Set(ctx, key, value, ttl).Err())
+}
+
+func (c *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	return c.fail(c.client.Del(ctx, keys...).Err())
+}
+
+// RedisBroadcaster broadcasts invalidations over Redis pub/sub. Each message
+// is the sender ID followed by the keys, one per line, so an instance can
+// skip its own messages.
+type RedisBroadcaster struct {
+	client  *redis.Client
+	channel string
+	id      string
+}
+
+// NewRedisBroadcaster creates a broadcaster publishing on channel with a
+// random instance ID
+func NewRedisBroadcaster(client *redis.Client, channel string) *RedisBroadcaster {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	return &RedisBroadcaster{client: client, channel: channel, id: hex.EncodeToString(id)}
+}
+
+func (b *RedisBroadcaster) Publish(ctx context.Context, keys ...string) error {
+	message := b.id + "\n" + strings.Join(keys, "\n")
+	return b.client.Publish(ctx, b.channel, message).Err()
+}
+
+func (b *RedisBroadcaster) Subscribe(ctx context.Context, ready func(), invalidate func(keys []string)) error {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	defer pubsub.Close()
+
+	// wait for the subscription, so no invalidation published after ready is
+	// called is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	messages := pubsub.Channel()
+	ready()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case message, ok := <-messages:
+			if !ok {
+				return nil
+			}
+
+			lines := strings.Split(message.Payload, "\n")
+			if lines[0] == b.id {
+				continue
+			}
+
+			invalidate(lines[1:])
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cursor"
+	"rinha-backend-go/person"
+)
+
+// generationKey holds the search generation. Search results are cached under
+// keys including it, so replacing it makes every cached result unreachable
+// at once. Generations are random so an evicted one is never reused.
+const generationKey = "people:generation"
+
+func newGeneration() []byte {
+	generation := make([]byte, 8)
+	_, _ = rand.Read(generation)
+	return []byte(hex.EncodeToString(generation))
+}
+
+// generation returns the current search generation, starting a new one if
+// there is none. It fails when the cache cannot be used.
+func (s *Store) generation(ctx context.Context) (string, bool) {
+	data, err := s.cache.Get(ctx, generationKey)
+	if err == nil {
+		return string(data), true
+	}
+
+	if err != ErrMiss {
+		return "", false
+	}
+
+	data = newGeneration()
+	if err := s.cache.Set(ctx, generationKey, data, 0); err != nil {
+		return "", false
+	}
+
+	return string(data), true
+}
+
+// invalidateSearches starts a new search generation, at most once per
+// SearchInvalidationInterval: a write in the interval after the last one
+// schedules one when it ends, so results may be stale for that long. If the
+// cache fails the results of the current one may be served for up to
+// SearchTTL.
+func (s *Store) invalidateSearches(ctx context.Context) {
+	if s.options.SearchTTL == 0 {
+		return
+	}
+
+	interval := s.options.SearchInvalidationInterval
+	if interval <= 0 {
+		_ = s.cache.Set(ctx, generationKey, newGeneration(), 0)
+		return
+	}
+
+	s.invalidationMu.Lock()
+	defer s.invalidationMu.Unlock()
+
+	if s.scheduled {
+		return
+	}
+
+	wait := interval - time.Since(s.invalidated)
+	if wait <= 0 {
+		s.invalidated = time.Now()
+		_ = s.cache.Set(ctx, generationKey, newGeneration(), 0)
+		return
+	}
+
+	s.scheduled = true
+
+	// the write has returned by then, only the values of its context are kept
+	ctx = context.WithoutCancel(ctx)
+	time.AfterFunc(wait, func() {
+		s.invalidationMu.Lock()
+		defer s.invalidationMu.Unlock()
+
+		s.scheduled = false
+		s.invalidated = time.Now()
+		_ = s.cache.Set(ctx, generationKey, newGeneration(), 0)
+	})
+}
+
+// searchKey identifies the results of a GetPeople call in a generation. The
+// stores ignore case, so the term is lowercased and hashed with the other
+// options to keep the key short.
+func searchKey(generation string, options *persistence.GetPeopleOptions) string {
+	if options == nil {
+		options = &persistence.GetPeopleOptions{}
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\n%d\n", options.SearchMode, options.Limit())
+
+	for _, c := range []*cursor.Cursor{options.After, options.Before} {
+		if c == nil {
+			fmt.Fprint(hash, "-\n")
+		} else {
+			fmt.Fprintf(hash, "%d:%d\n", c.ID, c.CreatedAt)
+		}
+	}
+
+	hash.Write([]byte(strings.ToLower(options.SearchQuery)))
+
+	return "people:" + generation + ":" + hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+func encodePeople(people person.People) ([]byte, error) {
+	records := make([]record, 0, len(people))
+	for _, p := range people {
+		records = append(records, newRecord(p))
+	}
+
+	return json.Marshal(records)
+}
+
+func decodePeople(data []byte) (person.People, error) {
+	var records []record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+
+	var people person.People
+	for _, r := range records {
+		people = append(people, r.person())
+	}
+
+	return people, nil
+}
+
+func (s *Store) GetPeople(ctx context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
+	if s.options.SearchTTL == 0 {
+		return s.Store.GetPeople(ctx, options)
+	}
+
+	generation, ok := s.generation(ctx)
+	if !ok {
+		return s.Store.GetPeople(ctx, options)
+	}
+
+	key := searchKey(generation, options)
+
+	if data, err := s.cache.Get(ctx, key); err == nil {
+		if people, err := decodePeople(data); err == nil {
+			return people, nil
+		}
+	}
+
+	people, err := s.Store.GetPeople(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key is new to this generation, no instance holds another value
+	if data, err := encodePeople(people); err == nil {
+		_ = Fill(ctx, s.cache, key, data, s.options.SearchTTL)
+	}
+
+	return people, nil
+}
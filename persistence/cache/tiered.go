@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Broadcaster fans invalidated keys out to the other API instances
+type Broadcaster interface {
+	Publish(ctx context.Context, keys ...string) error
+	// Subscribe calls ready once it is listening, then invalidate with the
+	// keys published by the other instances until ctx is done
+	Subscribe(ctx context.Context, ready func(), invalidate func(keys []string)) error
+}
+
+// TierStats counts the lookups answered by each tier of a TieredCache
+type TierStats struct {
+	Local  Stats
+	Remote Stats
+}
+
+// TieredCache keeps the recently used entries of a shared remote cache in
+// process. Writes go to both tiers and are broadcast so the other instances
+// drop their local copy, fills go to both tiers without a broadcast. An invalidation missed while the subscription is down
+// leaves a stale local entry for at most localTTL.
+type TieredCache struct {
+	local       *LRUCache
+	remote      Cache
+	broadcaster Broadcaster
+	localTTL    time.Duration
+
+	remoteStats counters
+	// subscribed is set while the invalidation subscription is running
+	subscribed atomic.Bool
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// NewTieredCache layers local in front of remote and starts listening for
+// the invalidations of the other instances, until Close is called
+func NewTieredCache(local *LRUCache, remote Cache, broadcaster Broadcaster, localTTL time.Duration) *TieredCache {
+	ctx, stop := context.WithCancel(context.Background())
+
+	c := &TieredCache{
+		local:       local,
+		remote:      remote,
+		broadcaster: broadcaster,
+		localTTL:    localTTL,
+		stop:        stop,
+		done:        make(chan struct{}),
+	}
+
+	go c.listen(ctx)
+
+	return c
+}
+
+// listen keeps the invalidation subscription running, resubscribing after a
+// failure. Local entries may have missed invalidations while it was down, so
+// they are all dropped when it comes back.
+func (c *TieredCache) listen(ctx context.Context) {
+	defer close(c.done)
+
+	invalidate := func(keys []string) {
+		_ = c.local.Delete(ctx, keys...)
+	}
+
+	ready := func() {
+		c.local.Clear()
+		c.subscribed.Store(true)
+	}
+
+	for ctx.Err() == nil {
+		_ = c.broadcaster.Subscribe(ctx, ready, invalidate)
+		c.subscribed.Store(false)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (c *TieredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if value, err := c.local.Get(ctx, key); err == nil {
+		return value, nil
+	}
+
+	value, err := c.remote.Get(ctx, key)
+	if err != nil {
+		if err == ErrMiss {
+			c.remoteStats.miss()
+		}
+		return nil, err
+	}
+
+	c.remoteStats.hit()
+
+	// entries are only kept locally while invalidations can reach them
+	if c.subscribed.Load() {
+		_ = c.local.Set(ctx, key, value, c.localTTL)
+	}
+
+	return value, nil
+}
+
+func (c *TieredCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := c.Fill(ctx, key, value, ttl); err != nil {
+		return err
+	}
+
+	return c.broadcaster.Publish(ctx, key)
+}
+
+// Fill caches a value read from the store without broadcasting it, the other
+// instances may only hold the same value
+func (c *TieredCache) Fill(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := c.remote.Set(ctx, key, value, ttl); err != nil {
+		_ = c.local.Delete(ctx, key)
+		return err
+	}
+
+	if ttl == 0 || ttl > c.localTTL {
+		ttl = c.localTTL
+	}
+
+	if c.subscribed.Load() {
+		_ = c.local.Set(ctx, key, value, ttl)
+	}
+
+	return nil
+}
+
+func (c *TieredCache) Delete(ctx context.Context, keys ...string) error {
+	_ = c.local.Delete(ctx, keys...)
+
+	if err := c.remote.Delete(ctx, keys...); err != nil {
+		return err
+	}
+
+	return c.broadcaster.Publish(ctx, keys...)
+}
+
+// Stats returns the lookups answered by each tier, a remote lookup only
+// happens after a local miss
+func (c *TieredCache) Stats() TierStats {
+	return TierStats{Local: c.local.Stats(), Remote: c.remoteStats.Stats()}
+}
+
+// Close stops listening for invalidations
+func (c *TieredCache) Close() error {
+	c.stop()
+	<-c.done
+	return nil
+}
@@ -0,0 +1,139 @@
+// Package cursor encodes the pagination cursors handed out by GET /pessoas as
+// opaque, signed tokens bound to the search query they were issued for.
+package cursor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"rinha-backend-go/person"
+)
+
+// version is the first byte of every token, bump it when the layout changes
+const version byte = 3
+
+const (
+	fingerprintSize = 8
+	signatureSize   = 16
+	// payloadSize is version, direction, id, created_at, page and the query
+	// fingerprint
+	payloadSize = 1 + 1 + 8 + 8 + 4 + fingerprintSize
+	tokenSize   = payloadSize + signatureSize
+)
+
+var (
+	// ErrInvalidCursor is wrapped by every error returned from Decode
+	ErrInvalidCursor = errors.New("Invalid pagination cursor")
+
+	errMalformed     = fmt.Errorf("%w: malformed", ErrInvalidCursor)
+	errVersion       = fmt.Errorf("%w: unsupported version", ErrInvalidCursor)
+	errDirection     = fmt.Errorf("%w: unknown direction", ErrInvalidCursor)
+	errSignature     = fmt.Errorf("%w: bad signature", ErrInvalidCursor)
+	errQueryMismatch = fmt.Errorf("%w: issued for another search", ErrInvalidCursor)
+)
+
+// Direction tells on which side of the cursor the page is
+type Direction byte
+
+const (
+	// Forward pages start right after the cursor
+	Forward Direction = iota
+	// Backward pages end right before the cursor
+	Backward
+)
+
+// Cursor points at the person a page starts after or ends before
+type Cursor struct {
+	Direction Direction
+	ID        int64
+	// CreatedAt is the creation time of the person in Unix seconds
+	CreatedAt int64
+	// Page is the number of the page the cursor leads to
+	Page int
+}
+
+// FromPerson returns the forward cursor pointing at p, without a page number
+func FromPerson(p *person.Person) Cursor {
+	return Cursor{ID: int64(p.ID), CreatedAt: p.CreatedAt.Unix()}
+}
+
+// Codec signs and verifies cursors. Every API instance behind the load
+// balancer must use the same key.
+type Codec struct {
+	key []byte
+}
+
+func NewCodec(key []byte) *Codec {
+	return &Codec{key: key}
+}
+
+func fingerprint(query string) []byte {
+	sum := sha256.Sum256([]byte(query))
+	return sum[:fingerprintSize]
+}
+
+func (c *Codec) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:signatureSize]
+}
+
+// Encode returns the token for cursor, bound to the search query
+func (c *Codec) Encode(cursor Cursor, query string) string {
+	token := make([]byte, payloadSize, tokenSize)
+	token[0] = version
+	token[1] = byte(cursor.Direction)
+	binary.BigEndian.PutUint64(token[2:10], uint64(cursor.ID))
+	binary.BigEndian.PutUint64(token[10:18], uint64(cursor.CreatedAt))
+	binary.BigEndian.PutUint32(token[18:22], uint32(cursor.Page))
+	copy(token[22:payloadSize], fingerprint(query))
+
+	token = append(token, c.sign(token)...)
+
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// Decode verifies the token and returns its cursor. It fails with an error
+// wrapping ErrInvalidCursor if the token was tampered with or issued for a
+// different search query.
+func (c *Codec) Decode(token string, query string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) == 0 {
+		return Cursor{}, errMalformed
+	}
+
+	if raw[0] != version {
+		return Cursor{}, errVersion
+	}
+
+	if len(raw) != tokenSize {
+		return Cursor{}, errMalformed
+	}
+
+	payload, signature := raw[:payloadSize], raw[payloadSize:]
+
+	if !hmac.Equal(signature, c.sign(payload)) {
+		return Cursor{}, errSignature
+	}
+
+	if !hmac.Equal(payload[22:payloadSize], fingerprint(query)) {
+		return Cursor{}, errQueryMismatch
+	}
+
+	direction := Direction(payload[1])
+
+	if direction != Forward && direction != Backward {
+		return Cursor{}, errDirection
+	}
+
+	return Cursor{
+		Direction: direction,
+		ID:        int64(binary.BigEndian.Uint64(payload[2:10])),
+		CreatedAt: int64(binary.BigEndian.Uint64(payload[10:18])),
+		Page:      int(binary.BigEndian.Uint32(payload[18:22])),
+	}, nil
+}
@@ -0,0 +1,62 @@
+package cursor
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	codec := NewCodec([]byte("secret"))
+	for _, cursor := range []Cursor{
+		{Direction: Forward, ID: 42, CreatedAt: 1690000000, Page: 3},
+		{Direction: Backward, ID: 7, CreatedAt: 1690000000, Page: 1},
+	} {
+		token := codec.Encode(cursor, "go")
+
+		decoded, err := codec.Decode(token, "go")
+		require.NoError(t, err)
+		require.Equal(t, cursor, decoded)
+	}
+}
+
+func TestRejectsInvalidTokens(t *testing.T) {
+	codec := NewCodec([]byte("secret"))
+	token := codec.Encode(Cursor{ID: 42, CreatedAt: 1690000000}, "go")
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	require.NoError(t, err)
+	raw[4] ^= 0xff
+	tampered := base64.RawURLEncoding.EncodeToString(raw)
+
+	raw[4] ^= 0xff
+	raw[0] = version + 1
+	future := base64.RawURLEncoding.EncodeToString(raw)
+
+	tests := map[string]struct {
+		codec *Codec
+		token string
+		query string
+		err   error
+	}{
+		"legacy token":  {codec, "42-1690000000", "go", errMalformed},
+		"empty":         {codec, "", "go", errMalformed},
+		"not base64":    {codec, "%%%", "go", errMalformed},
+		"truncated":     {codec, token[:10], "go", errMalformed},
+		"tampered":      {codec, tampered, "go", errSignature},
+		"version":       {codec, future, "go", errVersion},
+		"other query":   {codec, token, "python", errQueryMismatch},
+		"other key":     {NewCodec([]byte("other")), token, "go", errSignature},
+		"trailing data": {codec, token + "AAAA", "go", errMalformed},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := test.codec.Decode(test.token, test.query)
+			require.Equal(t, test.err, err)
+			require.True(t, errors.Is(err, ErrInvalidCursor))
+		})
+	}
+}
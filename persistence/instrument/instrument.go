@@ -0,0 +1,148 @@
+// Package instrument measures the calls to a store, exporting their latency
+// and errors as Prometheus metrics.
+package instrument
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cache"
+	"rinha-backend-go/person"
+)
+
+// Store records the duration of every call to the wrapped store, labelled by
+// method, and counts the calls that failed. Not finding a person or a taken
+// nickname are answers, not failures, and are not counted as errors.
+type Store struct {
+	store    persistence.Store
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+// NewStore wraps store, registering its metrics with registerer
+func NewStore(store persistence.Store, registerer prometheus.Registerer) *Store {
+	s := &Store{
+		store: store,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "store_call_duration_seconds",
+			Help:    "Duration of the persistence.Store calls.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "store_call_errors_total",
+			Help: "Number of persistence.Store calls that failed.",
+		}, []string{"method"}),
+	}
+
+	registerer.MustRegister(s.duration, s.errors)
+
+	return s
+}
+
+// observe records a call to method that started at start
+func (s *Store) observe(method string, start time.Time, err error) {
+	s.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+
+	if err != nil && err != persistence.ErrPersonNotFound && err != persistence.ErrNicknameTaken {
+		s.errors.WithLabelValues(method).Inc()
+	}
+}
+
+func (s *Store) AddPerson(ctx context.Context, p person.Person) (int64, error) {
+	start := time.Now()
+	id, err := s.store.AddPerson(ctx, p)
+	s.observe("AddPerson", start, err)
+	return id, err
+}
+
+func (s *Store) BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error) {
+	start := time.Now()
+	ids, err := s.store.BatchAddPeople(ctx, people)
+	s.observe("BatchAddPeople", start, err)
+	return ids, err
+}
+
+func (s *Store) GetPeople(ctx context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
+	start := time.Now()
+	people, err := s.store.GetPeople(ctx, options)
+	s.observe("GetPeople", start, err)
+	return people, err
+}
+
+// IteratePeople only measures opening the iterator, reading it is paced by
+// the caller
+func (s *Store) IteratePeople(ctx context.Context, query string) (persistence.PeopleIterator, error) {
+	start := time.Now()
+	people, err := s.store.IteratePeople(ctx, query)
+	s.observe("IteratePeople", start, err)
+	return people, err
+}
+
+func (s *Store) GetPerson(ctx context.Context, uuid string) (*person.Person, error) {
+	start := time.Now()
+	p, err := s.store.GetPerson(ctx, uuid)
+	s.observe("GetPerson", start, err)
+	return p, err
+}
+
+func (s *Store) GetPeopleCount(ctx context.Context) (int64, error) {
+	start := time.Now()
+	count, err := s.store.GetPeopleCount(ctx)
+	s.observe("GetPeopleCount", start, err)
+	return count, err
+}
+
+func (s *Store) UpdatePerson(ctx context.Context, p person.Person) error {
+	start := time.Now()
+	err := s.store.UpdatePerson(ctx, p)
+	s.observe("UpdatePerson", start, err)
+	return err
+}
+
+func (s *Store) PatchPerson(ctx context.Context, uuid string, patch persistence.PersonPatch) (*person.Person, error) {
+	start := time.Now()
+	p, err := s.store.PatchPerson(ctx, uuid, patch)
+	s.observe("PatchPerson", start, err)
+	return p, err
+}
+
+func (s *Store) DeletePerson(ctx context.Context, uuid string) error {
+	start := time.Now()
+	err := s.store.DeletePerson(ctx, uuid)
+	s.observe("DeletePerson", start, err)
+	return err
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.store.Ping(ctx)
+	s.observe("Ping", start, err)
+	return err
+}
+
+// RegisterCache exports the hits, misses and errors of a cache, labelled with
+// its name
+func RegisterCache(registerer prometheus.Registerer, name string, stats func() cache.Stats) {
+	labels := prometheus.Labels{"cache": name}
+
+	registerer.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "cache_hits_total",
+			Help:        "Number of cache lookups that found the entry.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "cache_misses_total",
+			Help:        "Number of cache lookups that did not find the entry.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "cache_errors_total",
+			Help:        "Number of cache operations that failed.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Errors) }),
+	)
+}
@@ -0,0 +1,96 @@
+package instrument
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cache"
+	"rinha-backend-go/persistence/memory"
+	"rinha-backend-go/persistence/storetest"
+	"rinha-backend-go/person"
+)
+
+func newMemoryStore(t *testing.T) persistence.Store {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+	return store
+}
+
+func TestStoreConformance(t *testing.T) {
+	storetest.RunStoreConformance(t, func(t *testing.T) persistence.Store {
+		return NewStore(newMemoryStore(t), prometheus.NewRegistry())
+	})
+}
+
+// failingStore fails every count
+type failingStore struct {
+	persistence.Store
+}
+
+func (failingStore) GetPeopleCount(context.Context) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestStoreMetrics(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	store := NewStore(failingStore{newMemoryStore(t)}, registry)
+
+	p := person.Person{
+		UUID:      "uuid-1",
+		Name:      "Person",
+		Nickname:  "nick",
+		Birthdate: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	_, err := store.AddPerson(ctx, p)
+	require.NoError(t, err)
+
+	_, err = store.AddPerson(ctx, p)
+	require.ErrorIs(t, err, persistence.ErrNicknameTaken)
+
+	_, err = store.GetPerson(ctx, "uuid-2")
+	require.ErrorIs(t, err, persistence.ErrPersonNotFound)
+
+	_, err = store.GetPeopleCount(ctx)
+	require.Error(t, err)
+
+	// one series per method called
+	require.Equal(t, 3, testutil.CollectAndCount(store.duration))
+
+	// only the failure is counted as an error
+	require.Equal(t, 1, testutil.CollectAndCount(store.errors))
+	require.Equal(t, float64(1), testutil.ToFloat64(store.errors.WithLabelValues("GetPeopleCount")))
+}
+
+func TestRegisterCache(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+
+	lru := cache.NewLRUCache(10, 0)
+	RegisterCache(registry, "local", lru.Stats)
+
+	require.NoError(t, lru.Set(ctx, "a", []byte("value"), time.Minute))
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, _ = lru.Get(ctx, key)
+	}
+
+	expected := `
+# HELP cache_hits_total Number of cache lookups that found the entry.
+# TYPE cache_hits_total counter
+cache_hits_total{cache="local"} 1
+# HELP cache_misses_total Number of cache lookups that did not find the entry.
+# TYPE cache_misses_total counter
+cache_misses_total{cache="local"} 2
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "cache_hits_total", "cache_misses_total"))
+}
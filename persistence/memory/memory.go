@@ -0,0 +1,421 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/person"
+)
+
+// MemoryStore keeps people in memory, optionally snapshotting them to a file
+// so they survive restarts. It is safe for concurrent use.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	// people is ordered by ID, matching the ORDER BY of the SQL stores
+	people     []*person.Person
+	byUUID     map[string]*person.Person
+	byNickname map[string]string
+	lastID     int64
+
+	snapshotPath string
+}
+
+// record is the snapshot representation of a person, person.Person hides
+// the ID and creation time from its JSON form
+type record struct {
+	ID        int       `json:"id"`
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Nickname  string    `json:"nickname"`
+	Birthdate time.Time `json:"birthdate"`
+	Stack     []string  `json:"stack"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type snapshot struct {
+	LastID int64    `json:"last_id"`
+	People []record `json:"people"`
+}
+
+func clonePerson(p *person.Person) *person.Person {
+	clone := *p
+
+	if p.Stack != nil {
+		clone.Stack = append([]string{}, p.Stack...)
+	}
+
+	return &clone
+}
+
+func (s *MemoryStore) GetPeopleCount(_ context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.people)), nil
+}
+
+func (s *MemoryStore) AddPerson(_ context.Context, p person.Person) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.byNickname[p.Nickname]; taken {
+		return 0, persistence.ErrNicknameTaken
+	}
+
+	return s.add(p), nil
+}
+
+// add stores p and returns its ID. The caller must hold the write lock and
+// have checked the nickname is free.
+func (s *MemoryStore) add(p person.Person) int64 {
+	s.lastID++
+
+	stored := clonePerson(&p)
+	stored.ID = int(s.lastID)
+	stored.CreatedAt = time.Now()
+
+	s.people = append(s.people, stored)
+	s.byUUID[stored.UUID] = stored
+	s.byNickname[stored.Nickname] = stored.UUID
+
+	return s.lastID
+}
+
+func (s *MemoryStore) BatchAddPeople(_ context.Context, people []person.Person) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int64, len(people))
+
+	for i, p := range people {
+		if _, taken := s.byNickname[p.Nickname]; taken {
+			continue
+		}
+
+		ids[i] = s.add(p)
+	}
+
+	return ids, nil
+}
+
+// matches reports whether the name, nickname or any stack entry of p
+// matches the search query, ignoring case
+func matches(p *person.Person, query string, mode persistence.SearchMode) bool {
+	query = strings.ToLower(query)
+
+	match := strings.Contains
+	if mode == persistence.SearchPrefix {
+		match = strings.HasPrefix
+	}
+
+	if match(strings.ToLower(p.Name), query) ||
+		match(strings.ToLower(p.Nickname), query) {
+		return true
+	}
+
+	for _, tech := range p.Stack {
+		if match(strings.ToLower(tech), query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *MemoryStore) GetPeople(_ context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var people person.People
+
+	if options != nil && options.SearchMode != persistence.SearchSubstring && options.SearchMode != persistence.SearchPrefix {
+		return nil, persistence.ErrSearchModeUnsupported
+	}
+
+	// backward pages are collected from the end and reversed afterwards
+	backward := options != nil && options.Before != nil
+
+	for i := range s.people {
+		p := s.people[i]
+		if backward {
+			p = s.people[len(s.people)-1-i]
+		}
+
+		if options != nil && options.SearchQuery != "" && !matches(p, options.SearchQuery, options.SearchMode) {
+			continue
+		}
+
+		if options != nil && options.After != nil && !(int64(p.ID) > options.After.ID && p.CreatedAt.Unix() >= options.After.CreatedAt) {
+			continue
+		}
+
+		if backward && !(int64(p.ID) < options.Before.ID && p.CreatedAt.Unix() <= options.Before.CreatedAt) {
+			continue
+		}
+
+		people = append(people, clonePerson(p))
+
+		if len(people) == options.Limit() {
+			break
+		}
+	}
+
+	if backward {
+		people.Reverse()
+	}
+
+	return people, nil
+}
+
+// peopleIterator walks the store by ID, taking the lock for each step so
+// writes go on while iterating
+type peopleIterator struct {
+	store  *MemoryStore
+	query  string
+	lastID int
+	person *person.Person
+}
+
+func (it *peopleIterator) Next() bool {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+
+	people := it.store.people
+	i := sort.Search(len(people), func(i int) bool { return people[i].ID > it.lastID })
+
+	for ; i < len(people); i++ {
+		if it.query == "" || matches(people[i], it.query, persistence.SearchSubstring) {
+			it.person = clonePerson(people[i])
+			it.lastID = it.person.ID
+			return true
+		}
+	}
+
+	it.person = nil
+
+	return false
+}
+
+func (it *peopleIterator) Person() *person.Person {
+	return it.person
+}
+
+func (it *peopleIterator) Err() error {
+	return nil
+}
+
+func (it *peopleIterator) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) IteratePeople(_ context.Context, query string) (persistence.PeopleIterator, error) {
+	return &peopleIterator{store: s, query: query}, nil
+}
+
+func (s *MemoryStore) GetPerson(_ context.Context, id string) (*person.Person, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.byUUID[id]
+	if !ok {
+		return nil, persistence.ErrPersonNotFound
+	}
+
+	return clonePerson(p), nil
+}
+
+// replace stores the updated fields of p over the current person. The
+// caller must hold the write lock.
+func (s *MemoryStore) replace(p person.Person) (*person.Person, error) {
+	current, ok := s.byUUID[p.UUID]
+	if !ok {
+		return nil, persistence.ErrPersonNotFound
+	}
+
+	if owner, taken := s.byNickname[p.Nickname]; taken && owner != p.UUID {
+		return nil, persistence.ErrNicknameTaken
+	}
+
+	delete(s.byNickname, current.Nickname)
+	s.byNickname[p.Nickname] = p.UUID
+
+	updated := clonePerson(&p)
+	current.Name = updated.Name
+	current.Nickname = updated.Nickname
+	current.Birthdate = updated.Birthdate
+	current.Stack = updated.Stack
+
+	return clonePerson(current), nil
+}
+
+func (s *MemoryStore) UpdatePerson(_ context.Context, p person.Person) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.replace(p)
+	return err
+}
+
+func (s *MemoryStore) PatchPerson(_ context.Context, id string, patch persistence.PersonPatch) (*person.Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.byUUID[id]
+	if !ok {
+		return nil, persistence.ErrPersonNotFound
+	}
+
+	p := clonePerson(current)
+	patch.Apply(p)
+
+	return s.replace(*p)
+}
+
+func (s *MemoryStore) DeletePerson(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.byUUID[id]
+	if !ok {
+		return persistence.ErrPersonNotFound
+	}
+
+	i := sort.Search(len(s.people), func(i int) bool { return s.people[i].ID >= p.ID })
+	s.people = append(s.people[:i], s.people[i+1:]...)
+
+	delete(s.byUUID, id)
+	delete(s.byNickname, p.Nickname)
+
+	return nil
+}
+
+// Ping always succeeds, the store has no database to reach
+func (s *MemoryStore) Ping(_ context.Context) error {
+	return nil
+}
+
+// Snapshot writes every person to the snapshot file. It is a no-op when the
+// store was created without one.
+func (s *MemoryStore) Snapshot() error {
+	if s.snapshotPath == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	data := snapshot{LastID: s.lastID, People: make([]record, 0, len(s.people))}
+	for _, p := range s.people {
+		data.People = append(data.People, record{
+			ID:        p.ID,
+			UUID:      p.UUID,
+			Name:      p.Name,
+			Nickname:  p.Nickname,
+			Birthdate: p.Birthdate,
+			Stack:     p.Stack,
+			CreatedAt: p.CreatedAt,
+		})
+	}
+	s.mu.RUnlock()
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a torn snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(s.snapshotPath), filepath.Base(s.snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.snapshotPath)
+}
+
+func (s *MemoryStore) load() error {
+	content, err := os.ReadFile(s.snapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var data snapshot
+	if err := json.Unmarshal(content, &data); err != nil {
+		return err
+	}
+
+	s.lastID = data.LastID
+
+	for _, r := range data.People {
+		p := &person.Person{
+			ID:        r.ID,
+			UUID:      r.UUID,
+			Name:      r.Name,
+			Nickname:  r.Nickname,
+			Birthdate: r.Birthdate,
+			Stack:     r.Stack,
+			CreatedAt: r.CreatedAt,
+		}
+
+		s.people = append(s.people, p)
+		s.byUUID[p.UUID] = p
+		s.byNickname[p.Nickname] = p.UUID
+	}
+
+	sort.Slice(s.people, func(i, j int) bool { return s.people[i].ID < s.people[j].ID })
+
+	return nil
+}
+
+// Close writes a final snapshot, if the store has a snapshot file
+func (s *MemoryStore) Close() error {
+	return s.Snapshot()
+}
+
+func init() {
+	// memory://SNAPSHOT, the snapshot path is optional
+	persistence.Register("memory", func(dsn string, _ persistence.OpenOptions) (persistence.Store, error) {
+		store, err := NewMemoryStore(strings.TrimPrefix(dsn, "memory://"))
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	})
+}
+
+// NewMemoryStore creates an empty store. When snapshotPath is not empty the
+// store is loaded from that file, if it exists, and written back to it on
+// Snapshot and Close.
+func NewMemoryStore(snapshotPath string) (*MemoryStore, error) {
+	s := &MemoryStore{
+		byUUID:       map[string]*person.Person{},
+		byNickname:   map[string]string{},
+		snapshotPath: snapshotPath,
+	}
+
+	if snapshotPath != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
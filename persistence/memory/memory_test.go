@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cursor"
+	"rinha-backend-go/persistence/storetest"
+	"rinha-backend-go/person"
+
+	"github.com/stretchr/testify/require"
+)
+
+func addPeople(t *testing.T, store *MemoryStore, n int) {
+	for i := 0; i < n; i++ {
+		_, err := store.AddPerson(context.Background(), person.Person{
+			UUID:      fmt.Sprintf("uuid-%v", i),
+			Name:      fmt.Sprintf("Person %v", i),
+			Nickname:  fmt.Sprintf("nick-%v", i),
+			Birthdate: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC),
+			Stack:     []string{"Go"},
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestGetPeoplePagination(t *testing.T) {
+	store, err := NewMemoryStore("")
+	require.NoError(t, err)
+
+	addPeople(t, store, 7)
+
+	page, err := store.GetPeople(context.Background(), &persistence.GetPeopleOptions{SearchQuery: "PERSON"})
+	require.NoError(t, err)
+	require.Len(t, page, 5)
+
+	after := cursor.FromPerson(page[len(page)-1])
+
+	page, err = store.GetPeople(context.Background(), &persistence.GetPeopleOptions{SearchQuery: "person", After: &after})
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.Equal(t, "uuid-5", page[0].UUID)
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "people.json")
+
+	store, err := NewMemoryStore(path)
+	require.NoError(t, err)
+
+	addPeople(t, store, 3)
+	require.NoError(t, store.DeletePerson(context.Background(), "uuid-1"))
+	require.NoError(t, store.Close())
+
+	store, err = NewMemoryStore(path)
+	require.NoError(t, err)
+
+	count, err := store.GetPeopleCount(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+
+	p, err := store.GetPerson(context.Background(), "uuid-2")
+	require.NoError(t, err)
+	require.Equal(t, "nick-2", p.Nickname)
+	require.Equal(t, []string{"Go"}, p.Stack)
+
+	id, err := store.AddPerson(context.Background(), person.Person{UUID: "uuid-3", Nickname: "nick-3"})
+	require.NoError(t, err)
+	require.EqualValues(t, 4, id)
+}
+
+func TestStoreConformance(t *testing.T) {
+	storetest.RunStoreConformance(t, func(t *testing.T) persistence.Store {
+		store, err := NewMemoryStore("")
+		require.NoError(t, err)
+
+		return store
+	})
+}
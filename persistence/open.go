@@ -0,0 +1,75 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownScheme is returned by Open for a DSN no backend registered
+var ErrUnknownScheme = errors.New("Unknown store scheme")
+
+// OpenOptions sizes the connection pool of the SQL backends, a zero field
+// keeps the backend default
+type OpenOptions struct {
+	MaxOpenConns int
+	MaxIdleConns int
+}
+
+// Opener opens a store from a DSN with the scheme it was registered for
+type Opener func(dsn string, options OpenOptions) (Store, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]Opener{}
+)
+
+// Register makes a backend available to Open under the URL scheme. Backends
+// register themselves when their package is imported, registering a scheme
+// twice panics.
+func Register(scheme string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+
+	if _, taken := openers[scheme]; taken {
+		panic("persistence: scheme registered twice: " + scheme)
+	}
+
+	openers[scheme] = opener
+}
+
+// Schemes returns the registered schemes, sorted
+func Schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// Open opens the store selected by the scheme of dsn, as in
+// postgres://user@host/db or sqlite://people.db. The stores hold resources
+// released by their Close method, see io.Closer.
+func Open(dsn string, options OpenOptions) (Store, error) {
+	scheme, _, ok := strings.Cut(dsn, "://")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q has no scheme", ErrUnknownScheme, dsn)
+	}
+
+	openersMu.RLock()
+	opener, ok := openers[scheme]
+	openersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q, registered: %v", ErrUnknownScheme, scheme, strings.Join(Schemes(), ", "))
+	}
+
+	return opener(dsn, options)
+}
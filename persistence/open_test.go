@@ -0,0 +1,28 @@
+package persistence
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	var opened string
+	Register("test", func(dsn string, _ OpenOptions) (Store, error) {
+		opened = dsn
+		return nil, errors.New("not a store")
+	})
+
+	_, err := Open("test://somewhere?option=1", OpenOptions{})
+	require.EqualError(t, err, "not a store")
+	require.Equal(t, "test://somewhere?option=1", opened)
+	require.Contains(t, Schemes(), "test")
+
+	for _, dsn := range []string{"unknown://somewhere", "somewhere", ""} {
+		_, err := Open(dsn, OpenOptions{})
+		require.ErrorIs(t, err, ErrUnknownScheme, dsn)
+	}
+
+	require.Panics(t, func() { Register("test", nil) })
+}
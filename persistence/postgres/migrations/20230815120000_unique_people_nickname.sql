@@ -0,0 +1,7 @@
+-- migrate:up
+    DROP INDEX IF EXISTS people_nickname_idx;
+    CREATE UNIQUE INDEX IF NOT EXISTS people_nickname_key ON people (nickname);
+-- migrate:down
+
+DROP INDEX IF EXISTS people_nickname_key;
+CREATE INDEX IF NOT EXISTS people_nickname_idx ON people (nickname);
@@ -0,0 +1,6 @@
+-- migrate:up
+    ALTER TABLE people ALTER COLUMN stack DROP NOT NULL;
+-- migrate:down
+
+UPDATE people SET stack = '{}' WHERE stack IS NULL;
+ALTER TABLE people ALTER COLUMN stack SET NOT NULL;
@@ -0,0 +1,20 @@
+-- migrate:up
+    CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+    -- array_to_string is only STABLE, generated columns need an IMMUTABLE
+    -- expression. Fields are joined with the unit separator so a match never
+    -- spans two of them.
+    CREATE OR REPLACE FUNCTION people_search_text(name varchar, nickname varchar, stack varchar[])
+      RETURNS text
+      LANGUAGE sql IMMUTABLE PARALLEL SAFE
+      AS $$ SELECT lower(name || E'\x1f' || nickname || E'\x1f' || coalesce(array_to_string(stack, E'\x1f'), '')) $$;
+
+    ALTER TABLE people ADD COLUMN search text
+      GENERATED ALWAYS AS (people_search_text(name, nickname, stack)) STORED;
+
+    CREATE INDEX IF NOT EXISTS people_search_trgm_idx ON people USING GIN (search gin_trgm_ops);
+-- migrate:down
+
+DROP INDEX IF EXISTS people_search_trgm_idx;
+ALTER TABLE people DROP COLUMN IF EXISTS search;
+DROP FUNCTION IF EXISTS people_search_text(varchar, varchar, varchar[]);
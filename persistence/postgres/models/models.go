@@ -19,4 +19,5 @@ type Person struct {
 	Birthdate time.Time
 	Stack     []string
 	CreatedAt sql.NullTime
+	Search    sql.NullString
 }
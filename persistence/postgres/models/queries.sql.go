@@ -50,6 +50,18 @@ func (q *Queries) CountPeople(ctx context.Context) (int64, error) {
 	return count, err
 }
 
+const deletePerson = `-- name: DeletePerson :execrows
+delete from people where uuid = $1
+`
+
+func (q *Queries) DeletePerson(ctx context.Context, argUuid uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deletePerson, argUuid)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const getPeople = `-- name: GetPeople :many
 select id,uuid,name,nickname,birthdate,stack,created_at
     from people
@@ -105,3 +117,50 @@ func (q *Queries) GetPerson(ctx context.Context, argUuid uuid.UUID) (Person, err
 	)
 	return i, err
 }
+
+const getPersonForUpdate = `-- name: GetPersonForUpdate :one
+SELECT id,uuid,name,nickname,birthdate,stack,created_at
+    FROM people WHERE uuid = $1 FOR UPDATE
+`
+
+func (q *Queries) GetPersonForUpdate(ctx context.Context, argUuid uuid.UUID) (Person, error) {
+	row := q.db.QueryRowContext(ctx, getPersonForUpdate, argUuid)
+	var i Person
+	err := row.Scan(
+		&i.ID,
+		&i.Uuid,
+		&i.Name,
+		&i.Nickname,
+		&i.Birthdate,
+		pq.Array(&i.Stack),
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const updatePerson = `-- name: UpdatePerson :execrows
+update people set name = $2, nickname = $3, birthdate = $4, stack = $5
+    where uuid = $1
+`
+
+type UpdatePersonParams struct {
+	Uuid      uuid.UUID
+	Name      string
+	Nickname  string
+	Birthdate time.Time
+	Stack     []string
+}
+
+func (q *Queries) UpdatePerson(ctx context.Context, arg UpdatePersonParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updatePerson,
+		arg.Uuid,
+		arg.Name,
+		arg.Nickname,
+		arg.Birthdate,
+		pq.Array(arg.Stack),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
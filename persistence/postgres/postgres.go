@@ -4,8 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"embed"
+	"fmt"
 	"net/url"
-	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
@@ -15,18 +15,62 @@ import (
 
 	"rinha-backend-go/persistence"
 	"rinha-backend-go/persistence/postgres/models"
+	"rinha-backend-go/persistence/tracing"
 	"rinha-backend-go/person"
 
 	_ "github.com/amacneil/dbmate/v2/pkg/driver/postgres"
 	_ "github.com/lib/pq"
 )
 
+const (
+	// uniqueViolation is the pq error code for unique_violation
+	uniqueViolation    = "23505"
+	nicknameConstraint = "people_nickname_key"
+)
+
 const (
 	selectPeople = `
     SELECT id,uuid,name,nickname,birthdate,stack,created_at
     FROM people`
 )
 
+// translateError maps driver errors to the persistence errors they represent
+func translateError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok {
+		if pqErr.Code == uniqueViolation && pqErr.Constraint == nicknameConstraint {
+			return persistence.ErrNicknameTaken
+		}
+	}
+
+	return err
+}
+
+// tracedDB records the statements of the generated queries in the span of
+// the store call running them
+type tracedDB struct {
+	db models.DBTX
+}
+
+func (t tracedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	tracing.Statement(ctx, query)
+	return t.db.ExecContext(ctx, query, args...)
+}
+
+func (t tracedDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	tracing.Statement(ctx, query)
+	return t.db.PrepareContext(ctx, query)
+}
+
+func (t tracedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	tracing.Statement(ctx, query)
+	return t.db.QueryContext(ctx, query, args...)
+}
+
+func (t tracedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	tracing.Statement(ctx, query)
+	return t.db.QueryRowContext(ctx, query, args...)
+}
+
 type PostgresStore struct {
 	queries *models.Queries
 	db      *sql.DB
@@ -42,28 +86,113 @@ func (s *PostgresStore) AddPerson(ctx context.Context, p person.Person) (int64,
 		return 0, err
 	}
 
-	stack := p.Stack
-
-	if stack == nil {
-		stack = []string{}
-	}
-
 	res, err := s.queries.AddPerson(ctx, models.AddPersonParams{
 		Name:      p.Name,
 		Uuid:      personUUID,
 		Nickname:  p.Nickname,
 		Birthdate: p.Birthdate,
-		Stack:     stack,
+		Stack:     p.Stack,
 	},
 	)
 
 	if err != nil {
-		return 0, err
+		return 0, translateError(err)
 	}
 
 	return int64(res), nil
 }
 
+const (
+	// createImportTable takes the columns from people, so the import accepts
+	// what the table does
+	createImportTable = `
+    CREATE TEMP TABLE people_import ON COMMIT DROP AS
+    SELECT 0 AS ord, uuid, name, nickname, birthdate, stack FROM people WHERE false`
+
+	// insertImported copies the imported rows in order, so the first of two
+	// people with the same nickname is the one kept
+	insertImported = `
+    INSERT INTO people (uuid,name,nickname,birthdate,stack)
+    SELECT uuid,name,nickname,birthdate,stack FROM people_import ORDER BY ord
+    ON CONFLICT (nickname) DO NOTHING
+    RETURNING id, uuid`
+)
+
+// BatchAddPeople streams the people with COPY into a temporary table and
+// moves them to people in a single statement, skipping the rows whose
+// nickname is taken. COPY cannot skip conflicts by itself.
+func (s *PostgresStore) BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error) {
+	ids := make([]int64, len(people))
+
+	if len(people) == 0 {
+		return ids, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, createImportTable); err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("people_import", "ord", "uuid", "name", "nickname", "birthdate", "stack"))
+	if err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not follow the import order, rows are matched by UUID
+	index := make(map[uuid.UUID]int, len(people))
+
+	for i, p := range people {
+		personUUID, err := uuid.Parse(p.UUID)
+		if err != nil {
+			stmt.Close()
+			return nil, err
+		}
+		index[personUUID] = i
+
+		if _, err := stmt.ExecContext(ctx, i, personUUID, p.Name, p.Nickname, p.Birthdate, pq.Array(p.Stack)); err != nil {
+			stmt.Close()
+			return nil, err
+		}
+	}
+
+	// the final Exec flushes the COPY
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return nil, err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return nil, err
+	}
+
+	tracing.Statement(ctx, insertImported)
+	rows, err := tx.QueryContext(ctx, insertImported)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var personUUID uuid.UUID
+		if err := rows.Scan(&id, &personUUID); err != nil {
+			return nil, err
+		}
+		ids[index[personUUID]] = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, tx.Commit()
+}
+
 func convertPersonDBToPerson(p models.Person) (*person.Person, error) {
 	return &person.Person{
 		ID:        int(p.ID),
@@ -79,7 +208,7 @@ func convertPersonDBToPerson(p models.Person) (*person.Person, error) {
 func (s *PostgresStore) GetPerson(ctx context.Context, uid string) (*person.Person, error) {
 	personUUID, err := uuid.Parse(uid)
 	if err != nil {
-		return nil, err
+		return nil, persistence.ErrPersonNotFound
 	}
 
 	p, err := s.queries.GetPerson(ctx, personUUID)
@@ -92,49 +221,163 @@ func (s *PostgresStore) GetPerson(ctx context.Context, uid string) (*person.Pers
 	return convertPersonDBToPerson(p)
 }
 
-func extractValuesFromPaginationToken(token string) (int64, int64) {
-	var id int64
-	var createdAt int64
+func (s *PostgresStore) UpdatePerson(ctx context.Context, p person.Person) error {
+	personUUID, err := uuid.Parse(p.UUID)
+	if err != nil {
+		return persistence.ErrPersonNotFound
+	}
+
+	return updatePerson(ctx, s.queries, personUUID, p)
+}
 
-	if token != "" {
-		values := strings.Split(token, "-")
-		id, _ = strconv.ParseInt(values[0], 10, 64)
-		createdAt, _ = strconv.ParseInt(values[1], 10, 64)
+func updatePerson(ctx context.Context, q *models.Queries, personUUID uuid.UUID, p person.Person) error {
+	affected, err := q.UpdatePerson(ctx, models.UpdatePersonParams{
+		Uuid:      personUUID,
+		Name:      p.Name,
+		Nickname:  p.Nickname,
+		Birthdate: p.Birthdate,
+		Stack:     p.Stack,
+	})
+
+	if err != nil {
+		return translateError(err)
+	}
+
+	if affected == 0 {
+		return persistence.ErrPersonNotFound
 	}
 
-	return id, createdAt
+	return nil
 }
 
-func containsQuery(s string) string {
-	return "%" + s + "%"
+func (s *PostgresStore) PatchPerson(ctx context.Context, uid string, patch persistence.PersonPatch) (*person.Person, error) {
+	personUUID, err := uuid.Parse(uid)
+	if err != nil {
+		return nil, persistence.ErrPersonNotFound
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := models.New(tracedDB{tx})
+
+	current, err := q.GetPersonForUpdate(ctx, personUUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, persistence.ErrPersonNotFound
+		}
+		return nil, err
+	}
+
+	p, err := convertPersonDBToPerson(current)
+	if err != nil {
+		return nil, err
+	}
+
+	patch.Apply(p)
+
+	err = updatePerson(ctx, q, personUUID, *p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, tx.Commit()
+}
+
+func (s *PostgresStore) DeletePerson(ctx context.Context, uid string) error {
+	personUUID, err := uuid.Parse(uid)
+	if err != nil {
+		return persistence.ErrPersonNotFound
+	}
+
+	affected, err := s.queries.DeletePerson(ctx, personUUID)
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return persistence.ErrPersonNotFound
+	}
+
+	return nil
 }
 
-func (s *PostgresStore) GetPeople(_ context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
+// likeEscaper escapes the LIKE wildcards so the search term matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// searchSeparator joins the fields of the search column, see the
+// people_search_text function
+const searchSeparator = "\x1f"
+
+func (s *PostgresStore) GetPeople(ctx context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
 	query := selectPeople
 
 	optionsValues := []interface{}{}
 
+	// placeholder returns the next positional parameter for value
+	placeholder := func(value interface{}) string {
+		optionsValues = append(optionsValues, value)
+		return fmt.Sprintf("$%d", len(optionsValues))
+	}
+
+	orderBy := " ORDER BY id ASC"
+
 	if options != nil && options.SearchQuery != "" {
-		query += " WHERE name LIKE $1 OR nickname LIKE $2 "
-		optionsValues = append(optionsValues, containsQuery(options.SearchQuery),
-			containsQuery(options.SearchQuery))
+		term := likeEscaper.Replace(options.SearchQuery)
+
+		switch options.SearchMode {
+		case persistence.SearchSubstring:
+			query += fmt.Sprintf(" WHERE search LIKE lower(%v) ", placeholder("%"+term+"%"))
+		case persistence.SearchPrefix:
+			// fields are separated by searchSeparator, a prefix match is at the
+			// start of the column or right after a separator
+			query += fmt.Sprintf(" WHERE (search LIKE lower(%v) OR search LIKE lower(%v)) ",
+				placeholder(term+"%"), placeholder("%"+searchSeparator+term+"%"))
+		case persistence.SearchSimilarity:
+			if options.After != nil || options.Before != nil {
+				return nil, persistence.ErrSearchModeUnsupported
+			}
+			ranked := placeholder(options.SearchQuery)
+			query += fmt.Sprintf(" WHERE lower(%v) <%% search ", ranked)
+			orderBy = fmt.Sprintf(" ORDER BY word_similarity(lower(%v), search) DESC, id ASC", ranked)
+		default:
+			return nil, persistence.ErrSearchModeUnsupported
+		}
 	}
 
-	if options != nil && options.PaginationToken != "" {
-		if options.SearchQuery == "" {
-			query += " WHERE "
-		} else {
-			query += " AND "
+	// where starts the first condition of the query and chains the others
+	filtered := options != nil && options.SearchQuery != ""
+	where := func() string {
+		if filtered {
+			return " AND "
 		}
-		query += "(id > ? and created_at >= ?) "
-		id, createdAt := extractValuesFromPaginationToken(options.PaginationToken)
-		optionsValues = append(optionsValues, id, createdAt)
+		filtered = true
+		return " WHERE "
+	}
 
+	// created_at has no time zone and is read back as UTC, the cursors
+	// timestamps are compared against it the same way
+	if options != nil && options.After != nil {
+		query += where() + fmt.Sprintf("(id > %v and created_at >= (to_timestamp(%v) AT TIME ZONE 'UTC')) ",
+			placeholder(options.After.ID), placeholder(options.After.CreatedAt))
 	}
 
-	query += " ORDER BY id ASC LIMIT 5;"
+	// the page before a cursor is the closest rows walking the index backwards
+	backward := options != nil && options.Before != nil
 
-	rows, err := s.db.Query(query, optionsValues...)
+	if backward {
+		query += where() + fmt.Sprintf("(id < %v and created_at <= (to_timestamp(%v) AT TIME ZONE 'UTC')) ",
+			placeholder(options.Before.ID), placeholder(options.Before.CreatedAt))
+		orderBy = " ORDER BY id DESC"
+	}
+
+	query += orderBy + fmt.Sprintf(" LIMIT %v;", placeholder(options.Limit()))
+
+	tracing.Statement(ctx, query)
+	rows, err := s.db.QueryContext(ctx, query, optionsValues...)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -144,22 +387,7 @@ func (s *PostgresStore) GetPeople(_ context.Context, options *persistence.GetPeo
 	var people person.People
 
 	for rows.Next() {
-		var p models.Person
-		err := rows.Scan(
-			&p.ID,
-			&p.Uuid,
-			&p.Name,
-			&p.Nickname,
-			&p.Birthdate,
-			pq.Array(&p.Stack),
-			&p.CreatedAt,
-		)
-
-		if err != nil {
-			return nil, err
-		}
-
-		person, err := convertPersonDBToPerson(p)
+		person, err := scanPerson(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -167,9 +395,130 @@ func (s *PostgresStore) GetPeople(_ context.Context, options *persistence.GetPeo
 		people = append(people, person)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if backward {
+		people.Reverse()
+	}
+
 	return people, nil
 }
 
+func scanPerson(rows *sql.Rows) (*person.Person, error) {
+	var p models.Person
+	err := rows.Scan(
+		&p.ID,
+		&p.Uuid,
+		&p.Name,
+		&p.Nickname,
+		&p.Birthdate,
+		pq.Array(&p.Stack),
+		&p.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return convertPersonDBToPerson(p)
+}
+
+// fetchSize is the number of rows read at a time from an export cursor
+const fetchSize = 500
+
+// peopleIterator reads the people from a server-side cursor, fetchSize rows
+// at a time. The cursor lives in a transaction held until Close.
+type peopleIterator struct {
+	ctx    context.Context
+	tx     *sql.Tx
+	rows   *sql.Rows
+	read   int
+	person *person.Person
+	err    error
+}
+
+func (it *peopleIterator) Next() bool {
+	for it.err == nil {
+		if it.rows != nil {
+			if it.rows.Next() {
+				it.read++
+				it.person, it.err = scanPerson(it.rows)
+				return it.err == nil
+			}
+
+			if it.err = it.rows.Err(); it.err != nil {
+				return false
+			}
+
+			it.rows.Close()
+
+			// a short fetch reached the end of the cursor
+			if it.read < fetchSize {
+				return false
+			}
+		}
+
+		it.read = 0
+		it.rows, it.err = it.tx.QueryContext(it.ctx, fmt.Sprintf("FETCH %d FROM people_export", fetchSize))
+	}
+
+	return false
+}
+
+func (it *peopleIterator) Person() *person.Person {
+	return it.person
+}
+
+func (it *peopleIterator) Err() error {
+	return it.err
+}
+
+func (it *peopleIterator) Close() error {
+	if it.rows != nil {
+		it.rows.Close()
+	}
+
+	// the transaction only read, rolling it back closes the cursor
+	return it.tx.Rollback()
+}
+
+func (s *PostgresStore) IteratePeople(ctx context.Context, query string) (persistence.PeopleIterator, error) {
+	statement := "DECLARE people_export NO SCROLL CURSOR FOR " + selectPeople
+
+	var values []interface{}
+
+	if query != "" {
+		statement += " WHERE search LIKE lower($1) "
+		values = append(values, "%"+likeEscaper.Replace(query)+"%")
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	statement += " ORDER BY id ASC"
+	tracing.Statement(ctx, statement)
+
+	if _, err := tx.ExecContext(ctx, statement, values...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &peopleIterator{ctx: ctx, tx: tx}, nil
+}
+
+// DB returns the connection pool of the store, to export its statistics
+func (s *PostgresStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
 func (s *PostgresStore) Close() error {
 	return s.db.Close()
 }
@@ -177,7 +526,22 @@ func (s *PostgresStore) Close() error {
 //go:embed migrations/*.sql
 var fs embed.FS
 
-func NewPostgresStore(dsn string) (*PostgresStore, error) {
+func init() {
+	open := func(dsn string, options persistence.OpenOptions) (persistence.Store, error) {
+		store, err := NewPostgresStore(dsn, options)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	persistence.Register("postgres", open)
+	persistence.Register("postgresql", open)
+}
+
+// NewMigrator returns the dbmate instance applying the embedded migrations to
+// the database at dsn
+func NewMigrator(dsn string) (*dbmate.DB, error) {
 	u, err := url.Parse(dsn)
 
 	if err != nil {
@@ -189,6 +553,21 @@ func NewPostgresStore(dsn string) (*PostgresStore, error) {
 	dbm.FS = fs
 	dbm.MigrationsDir = []string{"migrations"}
 
+	return dbm, nil
+}
+
+// The pool sizes used when persistence.OpenOptions leaves them zero
+const (
+	DefaultMaxOpenConns = 30
+	DefaultMaxIdleConns = 5
+)
+
+func NewPostgresStore(dsn string, options persistence.OpenOptions) (*PostgresStore, error) {
+	dbm, err := NewMigrator(dsn)
+	if err != nil {
+		return nil, err
+	}
+
 	err = dbm.CreateAndMigrate()
 	if err != nil {
 		return nil, err
@@ -198,10 +577,18 @@ func NewPostgresStore(dsn string) (*PostgresStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(30)
-	db.SetMaxIdleConns(5)
 
-	q := models.New(db)
+	if options.MaxOpenConns <= 0 {
+		options.MaxOpenConns = DefaultMaxOpenConns
+	}
+	if options.MaxIdleConns <= 0 {
+		options.MaxIdleConns = DefaultMaxIdleConns
+	}
+
+	db.SetMaxOpenConns(options.MaxOpenConns)
+	db.SetMaxIdleConns(options.MaxIdleConns)
+
+	q := models.New(tracedDB{db})
 
 	return &PostgresStore{db: db, queries: q}, nil
 }
@@ -0,0 +1,121 @@
+package postgres
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/storetest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestStoreConformance runs against the database in POSTGRES_TEST_DSN, which
+// is truncated before every test
+func TestStoreConformance(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set")
+	}
+
+	storetest.RunStoreConformance(t, func(t *testing.T) persistence.Store {
+		store, err := NewPostgresStore(dsn, persistence.OpenOptions{})
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+
+		_, err = store.db.Exec("TRUNCATE people RESTART IDENTITY")
+		require.NoError(t, err)
+
+		return store
+	})
+}
+
+// legacySearch is the query GetPeople ran before the trigram search column
+const legacySearch = selectPeople + `
+    WHERE (name ILIKE $1 OR nickname ILIKE $1
+      OR EXISTS (SELECT 1 FROM unnest(stack) AS tech WHERE tech ILIKE $1))
+    ORDER BY id ASC LIMIT 5;`
+
+// seedBenchmark fills the people table with n synthetic people. Names are
+// md5 hashes so a term taken from one of them matches a single row.
+func seedBenchmark(b *testing.B, store *PostgresStore, n int) string {
+	_, err := store.db.Exec("TRUNCATE people RESTART IDENTITY")
+	require.NoError(b, err)
+
+	_, err = store.db.Exec(`
+    INSERT INTO people (name, nickname, birthdate, stack)
+    SELECT 'Person ' || md5(i::text), 'nick' || i, date '1990-01-01', ARRAY['Go', 'Tech' || (i % 100)]
+    FROM generate_series(1, $1) AS i`, n)
+	require.NoError(b, err)
+
+	_, err = store.db.Exec("ANALYZE people")
+	require.NoError(b, err)
+
+	return fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(n/2))))[:10]
+}
+
+func explain(b *testing.B, store *PostgresStore, query string, args ...interface{}) {
+	rows, err := store.db.Query("EXPLAIN ANALYZE "+query, args...)
+	require.NoError(b, err)
+	defer rows.Close()
+
+	var plan strings.Builder
+	for rows.Next() {
+		var line string
+		require.NoError(b, rows.Scan(&line))
+		plan.WriteString(line + "\n")
+	}
+
+	b.Log("\n" + plan.String())
+}
+
+// BenchmarkSearch compares the legacy ILIKE scan with the trigram indexed
+// search column on BENCHMARK_PEOPLE people (10000 by default), logging both
+// query plans. Run with go test -bench Search -v.
+func BenchmarkSearch(b *testing.B) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+
+	if dsn == "" {
+		b.Skip("POSTGRES_TEST_DSN not set")
+	}
+
+	n := 10000
+	if value := os.Getenv("BENCHMARK_PEOPLE"); value != "" {
+		var err error
+		n, err = strconv.Atoi(value)
+		require.NoError(b, err)
+	}
+
+	store, err := NewPostgresStore(dsn, persistence.OpenOptions{})
+	require.NoError(b, err)
+	defer store.Close()
+
+	term := seedBenchmark(b, store, n)
+
+	b.Run("legacy", func(b *testing.B) {
+		explain(b, store, legacySearch, "%"+term+"%")
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			rows, err := store.db.Query(legacySearch, "%"+term+"%")
+			require.NoError(b, err)
+			rows.Close()
+		}
+	})
+
+	b.Run("trigram", func(b *testing.B) {
+		explain(b, store, selectPeople+" WHERE search LIKE lower($1) ORDER BY id ASC LIMIT 5;", "%"+term+"%")
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, err := store.GetPeople(context.Background(), &persistence.GetPeopleOptions{SearchQuery: term})
+			require.NoError(b, err)
+		}
+	})
+}
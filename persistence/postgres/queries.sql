@@ -6,9 +6,20 @@ insert into people (uuid,name,nickname,birthdate,stack)
 SELECT id,uuid,name,nickname,birthdate,stack,created_at
     FROM people WHERE uuid = $1;
 
+-- name: GetPersonForUpdate :one
+SELECT id,uuid,name,nickname,birthdate,stack,created_at
+    FROM people WHERE uuid = $1 FOR UPDATE;
+
 -- name: GetPeople :many
 select id,uuid,name,nickname,birthdate,stack,created_at
     from people;
 
 -- name: CountPeople :one
-select count(*) from people;
\ No newline at end of file
+select count(*) from people;
+
+-- name: UpdatePerson :execrows
+update people set name = $2, nickname = $3, birthdate = $4, stack = $5
+    where uuid = $1;
+
+-- name: DeletePerson :execrows
+delete from people where uuid = $1;
@@ -0,0 +1,38 @@
+//go:build sqlite_fts5
+
+package sqlite
+
+// ftsEnabled reports whether go-sqlite3 was built with FTS5, which needs the
+// sqlite_fts5 build tag
+const ftsEnabled = true
+
+// createSearchIndex creates a trigram FTS5 index over name, nickname and the
+// stack entries, kept in sync with people by triggers. Stack entries are
+// joined with the unit separator so a match never spans two of them.
+const createSearchIndex = `
+    CREATE VIRTUAL TABLE IF NOT EXISTS people_fts USING fts5(
+      name, nickname, stack,
+      tokenize = 'trigram case_sensitive 0'
+    );
+
+    CREATE TRIGGER IF NOT EXISTS people_fts_insert AFTER INSERT ON people BEGIN
+      INSERT INTO people_fts (rowid, name, nickname, stack)
+      VALUES (new.id, new.name, new.nickname, (SELECT group_concat(value, char(31)) FROM json_each(new.stack)));
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS people_fts_delete AFTER DELETE ON people BEGIN
+      DELETE FROM people_fts WHERE rowid = old.id;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS people_fts_update AFTER UPDATE ON people BEGIN
+      DELETE FROM people_fts WHERE rowid = old.id;
+      INSERT INTO people_fts (rowid, name, nickname, stack)
+      VALUES (new.id, new.name, new.nickname, (SELECT group_concat(value, char(31)) FROM json_each(new.stack)));
+    END;
+
+    -- index people stored before the FTS table existed
+    INSERT INTO people_fts (rowid, name, nickname, stack)
+    SELECT id, name, nickname, (SELECT group_concat(value, char(31)) FROM json_each(people.stack))
+    FROM people
+    WHERE id > (SELECT ifnull(max(rowid), 0) FROM people_fts);
+  `
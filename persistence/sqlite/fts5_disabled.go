@@ -0,0 +1,10 @@
+//go:build !sqlite_fts5
+
+package sqlite
+
+// ftsEnabled reports whether go-sqlite3 was built with FTS5, which needs the
+// sqlite_fts5 build tag
+const ftsEnabled = false
+
+// createSearchIndex is empty without FTS5, GetPeople falls back to LIKE
+const createSearchIndex = ``
@@ -0,0 +1,48 @@
+//go:build sqlite_fts5 && cgo
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"rinha-backend-go/persistence"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchIndexBackfill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "people.db")
+
+	// a database created before the search index existed
+	db, err := sql.Open(driverName, path)
+	require.NoError(t, err)
+	_, err = db.Exec(createPeopleTable)
+	require.NoError(t, err)
+	_, err = db.Exec(insertPerson, "uuid-1", "Ada Lovelace", "countess", 0, `["Analytical Engine"]`, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store, err := OpenSQLiteStore(path, Options{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	people, err := store.GetPeople(context.Background(), &persistence.GetPeopleOptions{SearchQuery: "ENGINE"})
+	require.NoError(t, err)
+	require.Len(t, people, 1)
+	require.Equal(t, "uuid-1", people[0].UUID)
+
+	var plan string
+	rows, err := store.db.Query("EXPLAIN QUERY PLAN "+selectPeople+"WHERE id IN (SELECT rowid FROM people_fts WHERE people_fts MATCH ?1)", ftsPhrase("engine"))
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		require.NoError(t, rows.Scan(&id, &parent, &unused, &detail))
+		plan += detail + "\n"
+	}
+	require.Contains(t, plan, "VIRTUAL TABLE INDEX")
+}
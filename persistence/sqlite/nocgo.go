@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package sqlite
+
+import (
+	"errors"
+
+	"rinha-backend-go/persistence"
+)
+
+// go-sqlite3 needs cgo, without it the sqlite scheme only reports why it
+// cannot be opened, so the binary still runs against the other backends
+func init() {
+	persistence.Register("sqlite", func(string, persistence.OpenOptions) (persistence.Store, error) {
+		return nil, errors.New("SQLite support needs cgo, build with CGO_ENABLED=1")
+	})
+}
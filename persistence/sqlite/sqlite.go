@@ -1,19 +1,38 @@
+//go:build cgo
+
 package sqlite
 
 import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/tracing"
 	"rinha-backend-go/person"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// driverName is the go-sqlite3 driver registered with the casefold function
+const driverName = "sqlite3_casefold"
+
+func init() {
+	// SQLite's LIKE and lower() only fold ASCII, casefold lowers any unicode
+	// text so searches ignore case the same way ILIKE does on Postgres
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("casefold", strings.ToLower, true)
+		},
+	})
+}
+
 const (
 	createPeopleTable = `
     CREATE TABLE IF NOT EXISTS people (
@@ -27,7 +46,8 @@ const (
     );
 
     CREATE INDEX IF NOT EXISTS idx_people_name ON people (name);
-    CREATE INDEX IF NOT EXISTS idx_people_nickname ON people (nickname);
+    DROP INDEX IF EXISTS idx_people_nickname;
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_people_nickname_unique ON people (nickname);
     CREATE INDEX IF NOT EXISTS idx_people_created_at ON people (created_at);
     CREATE INDEX IF NOT EXISTS idx_people_uuid ON people (uuid);
   `
@@ -35,6 +55,11 @@ const (
     insert into people (uuid,name,nickname,birthdate,stack,created_at)
     values (?,?,?,?,?,?);
   `
+	insertPersonIfNicknameFree = `
+    insert into people (uuid,name,nickname,birthdate,stack,created_at)
+    values (?,?,?,?,?,?)
+    ON CONFLICT (nickname) DO NOTHING;
+  `
 
 	selectPeople = `
     SELECT id,uuid,name,nickname,birthdate,stack,created_at
@@ -44,16 +69,37 @@ const (
     SELECT id,uuid,name,nickname,birthdate,stack,created_at
     FROM people
     WHERE uuid= ?;
+  `
+	updatePerson = `
+    UPDATE people SET name = ?, nickname = ?, birthdate = ?, stack = ?
+    WHERE uuid = ?;
+  `
+	deletePerson = `
+    DELETE FROM people WHERE uuid = ?;
   `
 )
 
+// translateError maps driver errors to the persistence errors they represent
+func translateError(err error) error {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		if sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique && strings.Contains(sqliteErr.Error(), "people.nickname") {
+			return persistence.ErrNicknameTaken
+		}
+	}
+
+	return err
+}
+
 type SQLiteStore struct {
 	db *sql.DB
 }
 
 func (s *SQLiteStore) GetPeopleCount(ctx context.Context) (int64, error) {
+	const countPeople = "SELECT COUNT(*) FROM people"
+	tracing.Statement(ctx, countPeople)
+
 	var count int64
-	err := s.db.QueryRow("SELECT COUNT(*) FROM people").Scan(&count)
+	err := s.db.QueryRowContext(ctx, countPeople).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -101,69 +147,177 @@ func convertPersonDBToPerson(p PersonDB) (*person.Person, error) {
 		UUID:      p.UUID,
 		Name:      p.Name,
 		Nickname:  p.Nickname,
-		Birthdate: time.Unix(p.Birthdate, 0),
+		Birthdate: time.Unix(p.Birthdate, 0).UTC(),
 		Stack:     stack,
-		CreatedAt: time.Unix(p.CreatedAt, 0),
+		CreatedAt: time.Unix(p.CreatedAt, 0).UTC(),
 	}, nil
 }
 
-func (s *SQLiteStore) AddPerson(_ context.Context, p person.Person) (int64, error) {
+func (s *SQLiteStore) AddPerson(ctx context.Context, p person.Person) (int64, error) {
 	dbPerson, err := convertPersonToPersonDB(p)
 	if err != nil {
 		return 0, err
 	}
 
-	result, err := s.db.Exec(insertPerson, dbPerson.UUID, dbPerson.Name, dbPerson.Nickname, dbPerson.Birthdate, dbPerson.Stack, dbPerson.CreatedAt)
+	tracing.Statement(ctx, insertPerson)
+
+	result, err := s.db.ExecContext(ctx, insertPerson, dbPerson.UUID, dbPerson.Name, dbPerson.Nickname, dbPerson.Birthdate, dbPerson.Stack, dbPerson.CreatedAt)
 	if err != nil {
-		return 0, err
+		return 0, translateError(err)
 	}
 	return result.LastInsertId()
 }
 
-func extractValuesFromPaginationToken(token string) (int64, int64) {
-	var id int64
-	var createdAt int64
+// BatchAddPeople inserts the people in a single transaction, reusing one
+// prepared statement
+func (s *SQLiteStore) BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tracing.Statement(ctx, insertPersonIfNicknameFree)
+	stmt, err := tx.PrepareContext(ctx, insertPersonIfNicknameFree)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	ids := make([]int64, len(people))
+
+	for i, p := range people {
+		dbPerson, err := convertPersonToPersonDB(p)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := stmt.ExecContext(ctx, dbPerson.UUID, dbPerson.Name, dbPerson.Nickname, dbPerson.Birthdate, dbPerson.Stack, dbPerson.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		// the nickname was taken, the row was skipped
+		if affected == 0 {
+			continue
+		}
+
+		ids[i], err = result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ids, tx.Commit()
+}
+
+// likeEscaper escapes the LIKE wildcards so the search term matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// useSearchIndex reports whether the search can be answered by the FTS5
+// trigram index, which only matches substrings of at least three characters
+func useSearchIndex(options *persistence.GetPeopleOptions) bool {
+	return ftsEnabled &&
+		options.SearchMode == persistence.SearchSubstring &&
+		utf8.RuneCountInString(options.SearchQuery) >= 3
+}
+
+// ftsPhrase quotes the search query as an FTS5 phrase, so it is matched
+// literally as a substring
+func ftsPhrase(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// searchPattern returns the LIKE pattern for the search query and mode
+func searchPattern(s string, mode persistence.SearchMode) (string, error) {
+	term := likeEscaper.Replace(strings.ToLower(s))
+
+	switch mode {
+	case persistence.SearchSubstring:
+		return "%" + term + "%", nil
+	case persistence.SearchPrefix:
+		return term + "%", nil
+	default:
+		return "", persistence.ErrSearchModeUnsupported
+	}
+}
 
-	if token != "" {
-		values := strings.Split(token, "-")
-		id, _ = strconv.ParseInt(values[0], 10, 64)
-		createdAt, _ = strconv.ParseInt(values[1], 10, 64)
+// searchCondition returns the condition matching the search query, bound to
+// the first parameter, and its value
+func searchCondition(options *persistence.GetPeopleOptions) (string, interface{}, error) {
+	if useSearchIndex(options) {
+		return "id IN (SELECT rowid FROM people_fts WHERE people_fts MATCH ?1) ", ftsPhrase(options.SearchQuery), nil
 	}
 
-	return id, createdAt
+	pattern, err := searchPattern(options.SearchQuery, options.SearchMode)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return `(casefold(name) LIKE ?1 ESCAPE '\'
+      OR casefold(nickname) LIKE ?1 ESCAPE '\'
+      OR EXISTS (SELECT 1 FROM json_each(people.stack) WHERE casefold(ifnull(json_each.value, '')) LIKE ?1 ESCAPE '\')) `, pattern, nil
 }
 
-func containsQuery(s string) string {
-	return "%" + s + "%"
+func scanPerson(rows *sql.Rows) (*person.Person, error) {
+	var p PersonDB
+	err := rows.Scan(&p.ID, &p.UUID, &p.Name, &p.Nickname, &p.Birthdate, &p.Stack, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return convertPersonDBToPerson(p)
 }
 
-func (s *SQLiteStore) GetPeople(_ context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
+func (s *SQLiteStore) GetPeople(ctx context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
 
 	query := selectPeople
 
 	optionsValues := []interface{}{}
 
 	if options != nil && options.SearchQuery != "" {
-		query += "WHERE name LIKE ? OR nickname LIKE ? "
-		optionsValues = append(optionsValues, containsQuery(options.SearchQuery),
-			containsQuery(options.SearchQuery))
+		condition, value, err := searchCondition(options)
+		if err != nil {
+			return nil, err
+		}
+		query += "WHERE " + condition
+		optionsValues = append(optionsValues, value)
 	}
 
-	if options != nil && options.PaginationToken != "" {
-		if options.SearchQuery == "" {
-			query += "WHERE "
-		} else {
-			query += "AND "
+	// where starts the first condition of the query and chains the others
+	filtered := options != nil && options.SearchQuery != ""
+	where := func() string {
+		if filtered {
+			return "AND "
 		}
-		query += "(id > ? and created_at >= ?) "
-		id, createdAt := extractValuesFromPaginationToken(options.PaginationToken)
-		optionsValues = append(optionsValues, id, createdAt)
+		filtered = true
+		return "WHERE "
+	}
 
+	if options != nil && options.After != nil {
+		query += where() + "(id > ? and created_at >= ?) "
+		optionsValues = append(optionsValues, options.After.ID, options.After.CreatedAt)
 	}
 
-	query += "ORDER BY id ASC LIMIT 5;"
+	// the page before a cursor is the closest rows walking the index backwards
+	backward := options != nil && options.Before != nil
 
-	rows, err := s.db.Query(query, optionsValues...)
+	if backward {
+		query += where() + "(id < ? and created_at <= ?) "
+		optionsValues = append(optionsValues, options.Before.ID, options.Before.CreatedAt)
+		query += "ORDER BY id DESC LIMIT ?;"
+	} else {
+		query += "ORDER BY id ASC LIMIT ?;"
+	}
+	optionsValues = append(optionsValues, options.Limit())
+
+	tracing.Statement(ctx, query)
+	rows, err := s.db.QueryContext(ctx, query, optionsValues...)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -173,28 +327,88 @@ func (s *SQLiteStore) GetPeople(_ context.Context, options *persistence.GetPeopl
 	var people person.People
 
 	for rows.Next() {
-		var p PersonDB
-		err := rows.Scan(&p.ID, &p.UUID, &p.Name, &p.Nickname, &p.Birthdate, &p.Stack, &p.CreatedAt)
+		person, err := scanPerson(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		person, err := convertPersonDBToPerson(p)
+		people = append(people, person)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if backward {
+		people.Reverse()
+	}
 
+	return people, nil
+}
+
+// peopleIterator reads the people off the rows of a query as it goes
+type peopleIterator struct {
+	rows   *sql.Rows
+	person *person.Person
+	err    error
+}
+
+func (it *peopleIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+
+	it.person, it.err = scanPerson(it.rows)
+
+	return it.err == nil
+}
+
+func (it *peopleIterator) Person() *person.Person {
+	return it.person
+}
+
+func (it *peopleIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.rows.Err()
+}
+
+func (it *peopleIterator) Close() error {
+	return it.rows.Close()
+}
+
+func (s *SQLiteStore) IteratePeople(ctx context.Context, query string) (persistence.PeopleIterator, error) {
+	statement := selectPeople
+
+	var values []interface{}
+
+	if query != "" {
+		condition, value, err := searchCondition(&persistence.GetPeopleOptions{SearchQuery: query})
 		if err != nil {
 			return nil, err
 		}
+		statement += "WHERE " + condition
+		values = append(values, value)
+	}
 
-		people = append(people, person)
+	statement += "ORDER BY id ASC;"
+	tracing.Statement(ctx, statement)
 
+	rows, err := s.db.QueryContext(ctx, statement, values...)
+	if err != nil {
+		return nil, err
 	}
 
-	return people, nil
+	return &peopleIterator{rows: rows}, nil
 }
 
-func (s *SQLiteStore) GetPerson(_ context.Context, id string) (*person.Person, error) {
+func (s *SQLiteStore) GetPerson(ctx context.Context, id string) (*person.Person, error) {
+	tracing.Statement(ctx, selectPerson)
+
 	var p PersonDB
-	err := s.db.QueryRow(selectPerson, id).Scan(&p.ID, &p.UUID, &p.Name, &p.Nickname, &p.Birthdate, &p.Stack, &p.CreatedAt)
+	err := s.db.QueryRowContext(ctx, selectPerson, id).Scan(&p.ID, &p.UUID, &p.Name, &p.Nickname, &p.Birthdate, &p.Stack, &p.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, persistence.ErrPersonNotFound
@@ -205,17 +419,221 @@ func (s *SQLiteStore) GetPerson(_ context.Context, id string) (*person.Person, e
 	return convertPersonDBToPerson(p)
 }
 
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func updatePersonRow(ctx context.Context, db execer, p person.Person) error {
+	dbPerson, err := convertPersonToPersonDB(p)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.ExecContext(ctx, updatePerson, dbPerson.Name, dbPerson.Nickname, dbPerson.Birthdate, dbPerson.Stack, dbPerson.UUID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return persistence.ErrPersonNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) UpdatePerson(ctx context.Context, p person.Person) error {
+	tracing.Statement(ctx, updatePerson)
+	return updatePersonRow(ctx, s.db, p)
+}
+
+func (s *SQLiteStore) PatchPerson(ctx context.Context, id string, patch persistence.PersonPatch) (*person.Person, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current PersonDB
+	err = tx.QueryRowContext(ctx, selectPerson, id).Scan(&current.ID, &current.UUID, &current.Name, &current.Nickname, &current.Birthdate, &current.Stack, &current.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, persistence.ErrPersonNotFound
+		}
+		return nil, err
+	}
+
+	p, err := convertPersonDBToPerson(current)
+	if err != nil {
+		return nil, err
+	}
+
+	patch.Apply(p)
+
+	tracing.Statement(ctx, updatePerson)
+	err = updatePersonRow(ctx, tx, *p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, tx.Commit()
+}
+
+func (s *SQLiteStore) DeletePerson(ctx context.Context, id string) error {
+	tracing.Statement(ctx, deletePerson)
+	result, err := s.db.ExecContext(ctx, deletePerson, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return persistence.ErrPersonNotFound
+	}
+
+	return nil
+}
+
+// DB returns the connection pool of the store, to export its statistics
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
 func (s *SQLiteStore) Close() error {
 	return s.db.Close()
 }
 
 func NewSQLiteStore() (*SQLiteStore, error) {
-	db, err := sql.Open("sqlite3", "./people.db")
+	return OpenSQLiteStore("./people.db", Options{})
+}
+
+// MemoryPath opens a database held in memory, which lives as long as the store
+const MemoryPath = ":memory:"
+
+// Options sets the pragmas of every connection
+type Options struct {
+	// JournalMode is the journal_mode pragma, WAL lets readers go on while a
+	// transaction writes
+	JournalMode string
+	// BusyTimeout is how long a statement waits for the lock of a concurrent
+	// writer instead of failing with SQLITE_BUSY
+	BusyTimeout time.Duration
+	// Synchronous is the synchronous pragma, with WAL NORMAL only risks the
+	// last transactions on power loss
+	Synchronous string
+	// MaxOpenConns and MaxIdleConns size the connection pool, zero keeps the
+	// database/sql defaults
+	MaxOpenConns int
+	MaxIdleConns int
+}
+
+// DefaultOptions are used for the options left empty
+var DefaultOptions = Options{
+	JournalMode: "WAL",
+	BusyTimeout: 5 * time.Second,
+	Synchronous: "NORMAL",
+}
+
+func (o Options) withDefaults() Options {
+	if o.JournalMode == "" {
+		o.JournalMode = DefaultOptions.JournalMode
+	}
+	if o.BusyTimeout <= 0 {
+		o.BusyTimeout = DefaultOptions.BusyTimeout
+	}
+	if o.Synchronous == "" {
+		o.Synchronous = DefaultOptions.Synchronous
+	}
+	return o
+}
+
+func init() {
+	persistence.Register("sqlite", openDSN)
+}
+
+// openDSN opens sqlite://PATH, PATH being a file or MemoryPath. The pragmas
+// are set by the journal_mode, busy_timeout (a duration) and synchronous
+// query parameters.
+func openDSN(dsn string, pool persistence.OpenOptions) (persistence.Store, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, "sqlite://"), "?")
+
+	if path == "" {
+		return nil, fmt.Errorf("SQLite DSN %q has no path", dsn)
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SQLite DSN parameters: %w", err)
+	}
+
+	options := Options{MaxOpenConns: pool.MaxOpenConns, MaxIdleConns: pool.MaxIdleConns}
+
+	for name := range params {
+		switch name {
+		case "journal_mode":
+			options.JournalMode = params.Get(name)
+		case "synchronous":
+			options.Synchronous = params.Get(name)
+		case "busy_timeout":
+			if options.BusyTimeout, err = time.ParseDuration(params.Get(name)); err != nil {
+				return nil, fmt.Errorf("invalid SQLite busy_timeout: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown SQLite DSN parameter %q", name)
+		}
+	}
+
+	store, err := OpenSQLiteStore(path, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// OpenSQLiteStore opens the database file at path, creating it if needed, or
+// an empty database in memory when path is MemoryPath
+func OpenSQLiteStore(path string, options Options) (*SQLiteStore, error) {
+	options = options.withDefaults()
+
+	params := url.Values{}
+	params.Set("_journal_mode", options.JournalMode)
+	params.Set("_busy_timeout", strconv.FormatInt(options.BusyTimeout.Milliseconds(), 10))
+	params.Set("_synchronous", options.Synchronous)
+
+	db, err := sql.Open(driverName, "file:"+path+"?"+params.Encode())
 
 	if err != nil {
 		return nil, err
 	}
 
+	if options.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(options.MaxOpenConns)
+	}
+	if options.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(options.MaxIdleConns)
+	}
+
+	if path == MemoryPath {
+		// every connection would open a database of its own, so a single
+		// one is kept open and the queries take turns on it
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+	}
+
 	// Create the people table if it doesn't exist
 	_, err = db.Exec(createPeopleTable)
 
@@ -223,6 +641,14 @@ func NewSQLiteStore() (*SQLiteStore, error) {
 		return nil, err
 	}
 
+	if ftsEnabled {
+		_, err = db.Exec(createSearchIndex)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &SQLiteStore{
 		db: db,
 	}, nil
@@ -0,0 +1,117 @@
+//go:build cgo
+
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/storetest"
+	"rinha-backend-go/persistence/tracing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	storetest.RunStoreConformance(t, func(t *testing.T) persistence.Store {
+		store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "people.db"), Options{})
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+
+		return store
+	})
+}
+
+func TestInMemoryStoreConformance(t *testing.T) {
+	storetest.RunStoreConformance(t, func(t *testing.T) persistence.Store {
+		store, err := OpenSQLiteStore(MemoryPath, Options{})
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+
+		return store
+	})
+}
+
+// pragma returns the value of the pragma on a connection of the store
+func pragma(t *testing.T, store *SQLiteStore, name string) string {
+	var value string
+	require.NoError(t, store.db.QueryRow("PRAGMA "+name).Scan(&value))
+	return value
+}
+
+func TestOpenDSN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "people.db")
+
+	opened, err := persistence.Open("sqlite://"+path, persistence.OpenOptions{})
+	require.NoError(t, err)
+	store := opened.(*SQLiteStore)
+
+	require.Equal(t, "wal", pragma(t, store, "journal_mode"))
+	require.Equal(t, "5000", pragma(t, store, "busy_timeout"))
+	// NORMAL
+	require.Equal(t, "1", pragma(t, store, "synchronous"))
+	require.NoError(t, store.Close())
+
+	opened, err = persistence.Open("sqlite://"+path+"?journal_mode=DELETE&busy_timeout=2s&synchronous=FULL", persistence.OpenOptions{MaxOpenConns: 2})
+	require.NoError(t, err)
+	store = opened.(*SQLiteStore)
+
+	require.Equal(t, "delete", pragma(t, store, "journal_mode"))
+	require.Equal(t, "2000", pragma(t, store, "busy_timeout"))
+	require.Equal(t, "2", pragma(t, store, "synchronous"))
+	require.Equal(t, 2, store.db.Stats().MaxOpenConnections)
+	require.NoError(t, store.Close())
+
+	for _, dsn := range []string{"sqlite://", "sqlite://" + path + "?busy_timeout=soon", "sqlite://" + path + "?journal=WAL"} {
+		_, err := persistence.Open(dsn, persistence.OpenOptions{})
+		require.Error(t, err, dsn)
+	}
+}
+
+func TestTracedStatements(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	store, err := OpenSQLiteStore(MemoryPath, Options{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	traced := tracing.NewStore(store, provider)
+
+	_, err = traced.GetPerson(context.Background(), "unknown")
+	require.ErrorIs(t, err, persistence.ErrPersonNotFound)
+
+	_, err = traced.GetPeopleCount(context.Background())
+	require.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	require.Contains(t, spans[0].Attributes, attribute.String("db.statement", selectPerson))
+	require.Contains(t, spans[1].Attributes, attribute.String("db.statement", "SELECT COUNT(*) FROM people"))
+}
+
+func TestCanceledContext(t *testing.T) {
+	store, err := OpenSQLiteStore(MemoryPath, Options{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = store.GetPeopleCount(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.GetPerson(ctx, "unknown")
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.GetPeople(ctx, &persistence.GetPeopleOptions{SearchQuery: "go"})
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = store.DeletePerson(ctx, "unknown")
+	require.ErrorIs(t, err, context.Canceled)
+}
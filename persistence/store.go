@@ -3,22 +3,117 @@ package persistence
 import (
 	"context"
 	"errors"
+	"time"
 
+	"rinha-backend-go/persistence/cursor"
 	"rinha-backend-go/person"
 )
 
+// SearchMode selects how GetPeopleOptions.SearchQuery is matched
+type SearchMode int
+
+const (
+	// SearchSubstring matches the query anywhere in the name, nickname or a
+	// stack entry
+	SearchSubstring SearchMode = iota
+	// SearchPrefix matches names, nicknames or stack entries starting with
+	// the query
+	SearchPrefix
+	// SearchSimilarity ranks people by trigram similarity to the query. The
+	// results are a single ranked page and cannot be paginated.
+	SearchSimilarity
+)
+
+// DefaultPageSize is the page size used when GetPeopleOptions.PageSize is not set
+const DefaultPageSize = 5
+
 type GetPeopleOptions struct {
-	PaginationToken string
-	SearchQuery     string
+	// After resumes the listing after the person the cursor points to
+	After *cursor.Cursor
+	// Before lists the page that ends right before the person the cursor
+	// points to. Stores fetch it in reverse ID order and return it ascending,
+	// like any other page.
+	Before      *cursor.Cursor
+	SearchQuery string
+	SearchMode  SearchMode
+	PageSize    int
+}
+
+// Limit returns the number of people to fetch
+func (o *GetPeopleOptions) Limit() int {
+	if o == nil || o.PageSize <= 0 {
+		return DefaultPageSize
+	}
+
+	return o.PageSize
+}
+
+// PersonPatch describes a partial update of a person. Nil fields are left
+// untouched, a Stack pointing to a nil slice clears the stack.
+type PersonPatch struct {
+	Name      *string
+	Nickname  *string
+	Birthdate *time.Time
+	Stack     *[]string
+}
+
+// Apply merges the patch into p
+func (patch PersonPatch) Apply(p *person.Person) {
+	if patch.Name != nil {
+		p.Name = *patch.Name
+	}
+
+	if patch.Nickname != nil {
+		p.Nickname = *patch.Nickname
+	}
+
+	if patch.Birthdate != nil {
+		p.Birthdate = *patch.Birthdate
+	}
+
+	if patch.Stack != nil {
+		p.Stack = *patch.Stack
+	}
+}
+
+// PeopleIterator walks over people in ID order. Person returns the person
+// Next moved to, Err the error that stopped the iteration, if any. The
+// iterator must be closed.
+type PeopleIterator interface {
+	Next() bool
+	Person() *person.Person
+	Err() error
+	Close() error
 }
 
 type Store interface {
 	AddPerson(context.Context, person.Person) (int64, error)
+	// BatchAddPeople adds the people in as few round trips as the store
+	// allows and returns their IDs in order. A person whose nickname is taken,
+	// including by an earlier person of the batch, gets a zero ID and does
+	// not fail the batch.
+	BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error)
 	GetPeople(ctx context.Context, options *GetPeopleOptions) (person.People, error)
+	// IteratePeople walks over every person matching the query as a
+	// substring, like SearchSubstring, or every person when it is empty,
+	// without loading them all in memory
+	IteratePeople(ctx context.Context, query string) (PeopleIterator, error)
+	// Ping checks the store can serve requests, reaching its database
+	Ping(ctx context.Context) error
 	GetPerson(context.Context, string) (*person.Person, error)
 	GetPeopleCount(ctx context.Context) (int64, error)
+	UpdatePerson(context.Context, person.Person) error
+	PatchPerson(ctx context.Context, uuid string, patch PersonPatch) (*person.Person, error)
+	DeletePerson(context.Context, string) error
 }
 
 var (
 	ErrPersonNotFound = errors.New("Person not found")
+	ErrNicknameTaken  = errors.New("Nickname already taken")
+
+	ErrSearchModeUnsupported = errors.New("Search mode not supported")
+
+	// ErrQueueFull is returned when a write cannot be queued because the
+	// store is behind on its queued writes
+	ErrQueueFull = errors.New("Write queue full")
 )
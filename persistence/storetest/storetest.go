@@ -0,0 +1,544 @@
+// Package storetest provides a conformance suite every persistence.Store
+// implementation must pass, so the backends keep behaving the same way.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cursor"
+	"rinha-backend-go/person"
+)
+
+// Factory returns a new, empty store. It is called once per test and should
+// register any cleanup with t.Cleanup.
+type Factory func(t *testing.T) persistence.Store
+
+// RunStoreConformance runs the conformance suite against the stores
+// returned by factory
+func RunStoreConformance(t *testing.T, factory Factory) {
+	suite.Run(t, &conformanceSuite{factory: factory})
+}
+
+type conformanceSuite struct {
+	suite.Suite
+	factory Factory
+	store   persistence.Store
+	ctx     context.Context
+}
+
+func (s *conformanceSuite) SetupTest() {
+	s.store = s.factory(s.T())
+	s.ctx = context.Background()
+}
+
+// newPerson builds a valid person with a fresh UUID and the given names
+func newPerson(name string, nickname string, stack []string) person.Person {
+	return person.Person{
+		UUID:      uuid.NewString(),
+		Name:      name,
+		Nickname:  nickname,
+		Birthdate: time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC),
+		Stack:     stack,
+	}
+}
+
+func (s *conformanceSuite) add(p person.Person) person.Person {
+	_, err := s.store.AddPerson(s.ctx, p)
+	s.Require().NoError(err)
+	return p
+}
+
+// after returns the cursor of the next page
+func after(people person.People) *cursor.Cursor {
+	c := cursor.FromPerson(people[len(people)-1])
+	return &c
+}
+
+// before returns the cursor of the previous page
+func before(people person.People) *cursor.Cursor {
+	c := cursor.FromPerson(people[0])
+	c.Direction = cursor.Backward
+	return &c
+}
+
+func uuids(people person.People) []string {
+	ids := make([]string, 0, len(people))
+	for _, p := range people {
+		ids = append(ids, p.UUID)
+	}
+	return ids
+}
+
+func (s *conformanceSuite) TestAddGetCount() {
+	count, err := s.store.GetPeopleCount(s.ctx)
+	s.Require().NoError(err)
+	s.Equal(int64(0), count)
+
+	p := s.add(newPerson("John Doe", "johndoe", []string{"Go", "Python"}))
+
+	got, err := s.store.GetPerson(s.ctx, p.UUID)
+	s.Require().NoError(err)
+	s.Equal(p.UUID, got.UUID)
+	s.Equal(p.Name, got.Name)
+	s.Equal(p.Nickname, got.Nickname)
+	s.True(p.Birthdate.Equal(got.Birthdate), "birthdate %v != %v", p.Birthdate, got.Birthdate)
+	s.Equal("1990-01-02", got.Birthdate.Format("2006-01-02"))
+	s.Equal(p.Stack, got.Stack)
+	s.NotZero(got.ID)
+	s.False(got.CreatedAt.IsZero())
+
+	count, err = s.store.GetPeopleCount(s.ctx)
+	s.Require().NoError(err)
+	s.Equal(int64(1), count)
+}
+
+func (s *conformanceSuite) TestAddReturnsIncreasingIDs() {
+	first, err := s.store.AddPerson(s.ctx, newPerson("John Doe", "johndoe", nil))
+	s.Require().NoError(err)
+
+	second, err := s.store.AddPerson(s.ctx, newPerson("Jane Doe", "janedoe", nil))
+	s.Require().NoError(err)
+
+	s.Greater(second, first)
+}
+
+func (s *conformanceSuite) TestBatchAddPeople() {
+	s.add(newPerson("Taken", "taken", nil))
+
+	people := []person.Person{
+		newPerson("John Doe", "johndoe", []string{"Go"}),
+		newPerson("Someone", "taken", nil),
+		newPerson("Jane Doe", "janedoe", nil),
+		newPerson("Jane Again", "janedoe", nil),
+	}
+
+	ids, err := s.store.BatchAddPeople(s.ctx, people)
+	s.Require().NoError(err)
+	s.Require().Len(ids, len(people))
+
+	s.NotZero(ids[0])
+	s.Zero(ids[1])
+	s.Greater(ids[2], ids[0])
+	s.Zero(ids[3])
+
+	got, err := s.store.GetPerson(s.ctx, people[0].UUID)
+	s.Require().NoError(err)
+	s.Equal(int(ids[0]), got.ID)
+	s.Equal([]string{"Go"}, got.Stack)
+
+	_, err = s.store.GetPerson(s.ctx, people[3].UUID)
+	s.Equal(persistence.ErrPersonNotFound, err)
+
+	count, err := s.store.GetPeopleCount(s.ctx)
+	s.Require().NoError(err)
+	s.Equal(int64(3), count)
+
+	ids, err = s.store.BatchAddPeople(s.ctx, nil)
+	s.Require().NoError(err)
+	s.Empty(ids)
+}
+
+// TestBatchAddLongFields adds through a batch the longest fields the API
+// accepts, like AddPerson does
+func (s *conformanceSuite) TestBatchAddLongFields() {
+	p := newPerson(strings.Repeat("n", 32), strings.Repeat("a", 40), []string{strings.Repeat("s", 10)})
+
+	ids, err := s.store.BatchAddPeople(s.ctx, []person.Person{p})
+	s.Require().NoError(err)
+	s.Require().Len(ids, 1)
+	s.NotZero(ids[0])
+
+	got, err := s.store.GetPerson(s.ctx, p.UUID)
+	s.Require().NoError(err)
+	s.Equal(p.Nickname, got.Nickname)
+}
+
+func (s *conformanceSuite) TestNicknameTaken() {
+	s.add(newPerson("John Doe", "johndoe", nil))
+
+	_, err := s.store.AddPerson(s.ctx, newPerson("Jane Doe", "johndoe", nil))
+	s.Equal(persistence.ErrNicknameTaken, err)
+
+	jane := s.add(newPerson("Jane Doe", "janedoe", nil))
+	jane.Nickname = "johndoe"
+	s.Equal(persistence.ErrNicknameTaken, s.store.UpdatePerson(s.ctx, jane))
+}
+
+func (s *conformanceSuite) TestNotFound() {
+	_, err := s.store.GetPerson(s.ctx, uuid.NewString())
+	s.Equal(persistence.ErrPersonNotFound, err)
+
+	_, err = s.store.GetPerson(s.ctx, "not-a-uuid")
+	s.Equal(persistence.ErrPersonNotFound, err)
+
+	s.Equal(persistence.ErrPersonNotFound, s.store.UpdatePerson(s.ctx, newPerson("John Doe", "johndoe", nil)))
+
+	name := "Jane Doe"
+	_, err = s.store.PatchPerson(s.ctx, uuid.NewString(), persistence.PersonPatch{Name: &name})
+	s.Equal(persistence.ErrPersonNotFound, err)
+
+	s.Equal(persistence.ErrPersonNotFound, s.store.DeletePerson(s.ctx, uuid.NewString()))
+}
+
+func (s *conformanceSuite) TestUpdatePatchDelete() {
+	p := s.add(newPerson("John Doe", "johndoe", []string{"Go"}))
+
+	p.Name = "Jane Doe"
+	p.Nickname = "janedoe"
+	p.Stack = []string{"Rust"}
+	s.Require().NoError(s.store.UpdatePerson(s.ctx, p))
+
+	got, err := s.store.GetPerson(s.ctx, p.UUID)
+	s.Require().NoError(err)
+	s.Equal("Jane Doe", got.Name)
+	s.Equal("janedoe", got.Nickname)
+	s.Equal([]string{"Rust"}, got.Stack)
+
+	nickname := "jdoe"
+	var stack []string
+	patched, err := s.store.PatchPerson(s.ctx, p.UUID, persistence.PersonPatch{Nickname: &nickname, Stack: &stack})
+	s.Require().NoError(err)
+	s.Equal("Jane Doe", patched.Name)
+	s.Equal("jdoe", patched.Nickname)
+	s.Nil(patched.Stack)
+
+	got, err = s.store.GetPerson(s.ctx, p.UUID)
+	s.Require().NoError(err)
+	s.Equal(patched.Nickname, got.Nickname)
+	s.Nil(got.Stack)
+
+	s.Require().NoError(s.store.DeletePerson(s.ctx, p.UUID))
+
+	_, err = s.store.GetPerson(s.ctx, p.UUID)
+	s.Equal(persistence.ErrPersonNotFound, err)
+
+	count, err := s.store.GetPeopleCount(s.ctx)
+	s.Require().NoError(err)
+	s.Equal(int64(0), count)
+}
+
+func (s *conformanceSuite) TestNilAndEmptyStack() {
+	withNil := s.add(newPerson("John Doe", "johndoe", nil))
+	withEmpty := s.add(newPerson("Jane Doe", "janedoe", []string{}))
+
+	got, err := s.store.GetPerson(s.ctx, withNil.UUID)
+	s.Require().NoError(err)
+	s.Nil(got.Stack)
+
+	got, err = s.store.GetPerson(s.ctx, withEmpty.UUID)
+	s.Require().NoError(err)
+	s.NotNil(got.Stack)
+	s.Empty(got.Stack)
+}
+
+func (s *conformanceSuite) TestUnicode() {
+	p := s.add(newPerson("João Ninguém", "ninguém", []string{"C++", "Ação"}))
+
+	got, err := s.store.GetPerson(s.ctx, p.UUID)
+	s.Require().NoError(err)
+	s.Equal("João Ninguém", got.Name)
+	s.Equal("ninguém", got.Nickname)
+	s.Equal([]string{"C++", "Ação"}, got.Stack)
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "Ninguém"})
+	s.Require().NoError(err)
+	s.Equal([]string{p.UUID}, uuids(people))
+}
+
+func (s *conformanceSuite) TestSearchNameAndNickname() {
+	byName := s.add(newPerson("Ada Lovelace", "countess", nil))
+	byNickname := s.add(newPerson("Grace Hopper", "adamant", nil))
+	s.add(newPerson("Alan Turing", "enigma", nil))
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "Love"})
+	s.Require().NoError(err)
+	s.Equal([]string{byName.UUID}, uuids(people))
+
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "mant"})
+	s.Require().NoError(err)
+	s.Equal([]string{byNickname.UUID}, uuids(people))
+
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "nothing matches this"})
+	s.Require().NoError(err)
+	s.Empty(people)
+}
+
+func (s *conformanceSuite) TestSearchStack() {
+	gopher := s.add(newPerson("Rob Pike", "commander", []string{"Go", "C"}))
+	s.add(newPerson("Guido van Rossum", "bdfl", []string{"Python"}))
+	s.add(newPerson("Nobody", "nobody", nil))
+	s.add(newPerson("Empty", "empty", []string{}))
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "go"})
+	s.Require().NoError(err)
+	s.Equal([]string{gopher.UUID}, uuids(people))
+}
+
+func (s *conformanceSuite) TestSearchIgnoresCase() {
+	ada := s.add(newPerson("Ada Lovelace", "countess", []string{"Analytical Engine"}))
+	joao := s.add(newPerson("JOÃO DA SILVA", "jsilva", nil))
+
+	for _, term := range []string{"ada", "ADA", "lOvElAcE", "COUNT", "engine"} {
+		people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: term})
+		s.Require().NoError(err)
+		s.Equal([]string{ada.UUID}, uuids(people), term)
+	}
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "joão"})
+	s.Require().NoError(err)
+	s.Equal([]string{joao.UUID}, uuids(people))
+}
+
+func (s *conformanceSuite) TestSearchIsLiteral() {
+	percent := s.add(newPerson("100% Coder", "percent", []string{"C_Sharp"}))
+	s.add(newPerson("Plain Coder", "plain", []string{"CSharp"}))
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "%"})
+	s.Require().NoError(err)
+	s.Equal([]string{percent.UUID}, uuids(people))
+
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "c_s"})
+	s.Require().NoError(err)
+	s.Equal([]string{percent.UUID}, uuids(people))
+}
+
+func (s *conformanceSuite) TestSearchPrefix() {
+	gopher := s.add(newPerson("Rob Pike", "commander", []string{"Go", "C"}))
+	s.add(newPerson("Hugo Gopher", "hugo", []string{"Python"}))
+	rust := s.add(newPerson("Graydon Hoare", "graydon", []string{"Rust"}))
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "go", SearchMode: persistence.SearchPrefix})
+	s.Require().NoError(err)
+	s.Equal([]string{gopher.UUID}, uuids(people))
+
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "GRAY", SearchMode: persistence.SearchPrefix})
+	s.Require().NoError(err)
+	s.Equal([]string{rust.UUID}, uuids(people))
+}
+
+func (s *conformanceSuite) TestSearchSimilarity() {
+	s.add(newPerson("Someone Else", "other", []string{"Java"}))
+	gopher := s.add(newPerson("Rob Pike", "commander", []string{"Golang"}))
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "golang", SearchMode: persistence.SearchSimilarity})
+	if err == persistence.ErrSearchModeUnsupported {
+		s.T().Skip("similarity search not supported")
+	}
+	s.Require().NoError(err)
+	s.Require().NotEmpty(people)
+	s.Equal(gopher.UUID, people[0].UUID)
+
+	_, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{
+		SearchQuery: "golang",
+		SearchMode:  persistence.SearchSimilarity,
+		After:       after(people),
+	})
+	s.Equal(persistence.ErrSearchModeUnsupported, err)
+
+	_, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{
+		SearchQuery: "golang",
+		SearchMode:  persistence.SearchSimilarity,
+		Before:      before(people),
+	})
+	s.Equal(persistence.ErrSearchModeUnsupported, err)
+}
+
+func (s *conformanceSuite) TestGetPeopleWithoutOptions() {
+	s.add(newPerson("John Doe", "johndoe", nil))
+
+	people, err := s.store.GetPeople(s.ctx, nil)
+	s.Require().NoError(err)
+	s.Len(people, 1)
+}
+
+func (s *conformanceSuite) TestPagination() {
+	var added []string
+	for i := 0; i < 12; i++ {
+		p := s.add(newPerson(fmt.Sprintf("Person %c", 'a'+i), fmt.Sprintf("nick %c", 'a'+i), nil))
+		added = append(added, p.UUID)
+	}
+	// people that do not match the search must not shift the pages
+	s.add(newPerson("Someone Else", "other", nil))
+
+	var seen []string
+	options := &persistence.GetPeopleOptions{SearchQuery: "Person"}
+
+	for pages := 0; ; pages++ {
+		s.Require().Less(pages, 4, "pagination did not terminate")
+
+		people, err := s.store.GetPeople(s.ctx, options)
+		s.Require().NoError(err)
+		s.LessOrEqual(len(people), 5)
+
+		seen = append(seen, uuids(people)...)
+
+		if len(people) < 5 {
+			break
+		}
+
+		options = &persistence.GetPeopleOptions{
+			SearchQuery: "Person",
+			After:       after(people),
+		}
+	}
+
+	s.Equal(added, seen)
+}
+
+func (s *conformanceSuite) TestBackwardPagination() {
+	var added []string
+	for i := 0; i < 12; i++ {
+		p := s.add(newPerson(fmt.Sprintf("Person %c", 'a'+i), fmt.Sprintf("nick %c", 'a'+i), nil))
+		added = append(added, p.UUID)
+	}
+	s.add(newPerson("Someone Else", "other", nil))
+
+	// walk forward to the last page, then back to the first one
+	var pages []person.People
+	options := &persistence.GetPeopleOptions{SearchQuery: "Person"}
+	for {
+		people, err := s.store.GetPeople(s.ctx, options)
+		s.Require().NoError(err)
+		pages = append(pages, people)
+
+		if len(people) < 5 {
+			break
+		}
+		options = &persistence.GetPeopleOptions{SearchQuery: "Person", After: after(people)}
+	}
+	s.Require().Len(pages, 3)
+
+	for i := len(pages) - 1; i > 0; i-- {
+		people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{
+			SearchQuery: "Person",
+			Before:      before(pages[i]),
+		})
+		s.Require().NoError(err)
+		s.Equal(uuids(pages[i-1]), uuids(people), "page %d", i)
+	}
+
+	// nothing comes before the first page
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "Person", Before: before(pages[0])})
+	s.Require().NoError(err)
+	s.Empty(people)
+
+	// a short page before the cursor still returns the closest people
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "Person", Before: before(pages[0][2:])})
+	s.Require().NoError(err)
+	s.Equal(added[:2], uuids(people))
+}
+
+func (s *conformanceSuite) TestPageSize() {
+	for i := 0; i < 8; i++ {
+		s.add(newPerson(fmt.Sprintf("Person %c", 'a'+i), fmt.Sprintf("nick %c", 'a'+i), nil))
+	}
+
+	people, err := s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "person"})
+	s.Require().NoError(err)
+	s.Len(people, persistence.DefaultPageSize)
+
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "person", PageSize: 3})
+	s.Require().NoError(err)
+	s.Len(people, 3)
+
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "person", PageSize: 3, After: after(people)})
+	s.Require().NoError(err)
+	s.Len(people, 3)
+
+	people, err = s.store.GetPeople(s.ctx, &persistence.GetPeopleOptions{SearchQuery: "person", PageSize: 20})
+	s.Require().NoError(err)
+	s.Len(people, 8)
+}
+
+func (s *conformanceSuite) TestPing() {
+	s.NoError(s.store.Ping(s.ctx))
+}
+
+// iterate collects the UUIDs of the people matching query with IteratePeople
+func (s *conformanceSuite) iterate(query string) []string {
+	it, err := s.store.IteratePeople(s.ctx, query)
+	s.Require().NoError(err)
+	defer func() { s.NoError(it.Close()) }()
+
+	var seen []string
+	for it.Next() {
+		seen = append(seen, it.Person().UUID)
+	}
+	s.Require().NoError(it.Err())
+
+	return seen
+}
+
+func (s *conformanceSuite) TestIteratePeople() {
+	s.Empty(s.iterate(""))
+
+	var added []string
+	for i := 0; i < 12; i++ {
+		p := s.add(newPerson(fmt.Sprintf("Person %c", 'a'+i), fmt.Sprintf("nick %c", 'a'+i), []string{"Go"}))
+		added = append(added, p.UUID)
+	}
+	other := s.add(newPerson("Someone Else", "other", nil))
+
+	s.Equal(append(append([]string(nil), added...), other.UUID), s.iterate(""))
+	s.Equal(added, s.iterate("PERSON"))
+	s.Equal([]string{other.UUID}, s.iterate("else"))
+	s.Empty(s.iterate("nothing matches this"))
+
+	it, err := s.store.IteratePeople(s.ctx, "")
+	s.Require().NoError(err)
+	s.Require().True(it.Next())
+	s.Equal(added[0], it.Person().UUID)
+	s.Equal([]string{"Go"}, it.Person().Stack)
+	s.NoError(it.Close())
+}
+
+func (s *conformanceSuite) TestConcurrentAdds() {
+	const workers = 8
+	const perWorker = 10
+
+	var wg sync.WaitGroup
+	ids := make(chan int64, workers*perWorker)
+	errs := make(chan error, workers*perWorker)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				id, err := s.store.AddPerson(s.ctx, newPerson("Worker", fmt.Sprintf("worker %v %v", w, i), nil))
+				if err != nil {
+					errs <- err
+					continue
+				}
+				ids <- id
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(ids)
+	close(errs)
+
+	for err := range errs {
+		s.NoError(err)
+	}
+
+	unique := map[int64]bool{}
+	for id := range ids {
+		unique[id] = true
+	}
+	s.Len(unique, workers*perWorker)
+
+	count, err := s.store.GetPeopleCount(s.ctx)
+	s.Require().NoError(err)
+	s.Equal(int64(workers*perWorker), count)
+}
@@ -0,0 +1,180 @@
+// Package tracing traces the calls to a store and to a cache as OpenTelemetry
+// spans, children of the span of the request making them.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cache"
+	"rinha-backend-go/person"
+)
+
+// instrumentationName names the tracer of the spans created here
+const instrumentationName = "rinha-backend-go/persistence/tracing"
+
+// Statement records the SQL statement run by a store in the span of the
+// store call, the backends call it with the context they were given. The
+// last statement of a call is kept.
+func Statement(ctx context.Context, statement string) {
+	trace.SpanFromContext(ctx).SetAttributes(semconv.DBStatement(statement))
+}
+
+// end ends the span, marking it failed when err is a failure. Not finding a
+// person or a taken nickname are answers, not failures.
+func end(span trace.Span, err error) {
+	if err != nil && err != persistence.ErrPersonNotFound && err != persistence.ErrNicknameTaken {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Store creates a span for every call to the wrapped store, named after the
+// method
+type Store struct {
+	store  persistence.Store
+	tracer trace.Tracer
+}
+
+// NewStore wraps store, creating its spans with provider
+func NewStore(store persistence.Store, provider trace.TracerProvider) *Store {
+	return &Store{store: store, tracer: provider.Tracer(instrumentationName)}
+}
+
+func (s *Store) start(ctx context.Context, method string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "store."+method, trace.WithSpanKind(trace.SpanKindClient))
+}
+
+func (s *Store) AddPerson(ctx context.Context, p person.Person) (int64, error) {
+	ctx, span := s.start(ctx, "AddPerson")
+	id, err := s.store.AddPerson(ctx, p)
+	end(span, err)
+	return id, err
+}
+
+func (s *Store) BatchAddPeople(ctx context.Context, people []person.Person) ([]int64, error) {
+	ctx, span := s.start(ctx, "BatchAddPeople")
+	span.SetAttributes(attribute.Int("people.count", len(people)))
+	ids, err := s.store.BatchAddPeople(ctx, people)
+	end(span, err)
+	return ids, err
+}
+
+func (s *Store) GetPeople(ctx context.Context, options *persistence.GetPeopleOptions) (person.People, error) {
+	ctx, span := s.start(ctx, "GetPeople")
+	people, err := s.store.GetPeople(ctx, options)
+	end(span, err)
+	return people, err
+}
+
+// IteratePeople only traces opening the iterator, reading it is paced by the
+// caller
+func (s *Store) IteratePeople(ctx context.Context, query string) (persistence.PeopleIterator, error) {
+	ctx, span := s.start(ctx, "IteratePeople")
+	people, err := s.store.IteratePeople(ctx, query)
+	end(span, err)
+	return people, err
+}
+
+func (s *Store) GetPerson(ctx context.Context, uuid string) (*person.Person, error) {
+	ctx, span := s.start(ctx, "GetPerson")
+	p, err := s.store.GetPerson(ctx, uuid)
+	end(span, err)
+	return p, err
+}
+
+func (s *Store) GetPeopleCount(ctx context.Context) (int64, error) {
+	ctx, span := s.start(ctx, "GetPeopleCount")
+	count, err := s.store.GetPeopleCount(ctx)
+	end(span, err)
+	return count, err
+}
+
+func (s *Store) UpdatePerson(ctx context.Context, p person.Person) error {
+	ctx, span := s.start(ctx, "UpdatePerson")
+	err := s.store.UpdatePerson(ctx, p)
+	end(span, err)
+	return err
+}
+
+func (s *Store) PatchPerson(ctx context.Context, uuid string, patch persistence.PersonPatch) (*person.Person, error) {
+	ctx, span := s.start(ctx, "PatchPerson")
+	p, err := s.store.PatchPerson(ctx, uuid, patch)
+	end(span, err)
+	return p, err
+}
+
+func (s *Store) DeletePerson(ctx context.Context, uuid string) error {
+	ctx, span := s.start(ctx, "DeletePerson")
+	err := s.store.DeletePerson(ctx, uuid)
+	end(span, err)
+	return err
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, span := s.start(ctx, "Ping")
+	err := s.store.Ping(ctx)
+	end(span, err)
+	return err
+}
+
+// Cache creates a span for every Get, Set, Fill and Delete of the wrapped cache. A
+// miss is an answer, it is recorded in the cache.hit attribute.
+type Cache struct {
+	cache  cache.Cache
+	tracer trace.Tracer
+}
+
+// NewCache wraps c, creating its spans with provider
+func NewCache(c cache.Cache, provider trace.TracerProvider) *Cache {
+	return &Cache{cache: c, tracer: provider.Tracer(instrumentationName)}
+}
+
+func (c *Cache) start(ctx context.Context, operation string, keys ...string) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, "cache."+operation, trace.WithAttributes(attribute.StringSlice("cache.keys", keys)))
+}
+
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, span := c.start(ctx, "Get", key)
+	value, err := c.cache.Get(ctx, key)
+
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+
+	failure := err
+	if errors.Is(err, cache.ErrMiss) {
+		failure = nil
+	}
+	end(span, failure)
+
+	return value, err
+}
+
+func (c *Cache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ctx, span := c.start(ctx, "Set", key)
+	err := c.cache.Set(ctx, key, value, ttl)
+	end(span, err)
+	return err
+}
+
+func (c *Cache) Fill(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ctx, span := c.start(ctx, "Fill", key)
+	err := cache.Fill(ctx, c.cache, key, value, ttl)
+	end(span, err)
+	return err
+}
+
+func (c *Cache) Delete(ctx context.Context, keys ...string) error {
+	ctx, span := c.start(ctx, "Delete", keys...)
+	err := c.cache.Delete(ctx, keys...)
+	end(span, err)
+	return err
+}
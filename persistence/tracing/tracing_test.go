@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"rinha-backend-go/persistence"
+	"rinha-backend-go/persistence/cache"
+	"rinha-backend-go/persistence/memory"
+	"rinha-backend-go/persistence/storetest"
+	"rinha-backend-go/person"
+)
+
+func newProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), exporter
+}
+
+func newMemoryStore(t *testing.T) persistence.Store {
+	store, err := memory.NewMemoryStore("")
+	require.NoError(t, err)
+	return store
+}
+
+func TestStoreConformance(t *testing.T) {
+	storetest.RunStoreConformance(t, func(t *testing.T) persistence.Store {
+		provider, _ := newProvider()
+		return NewStore(newMemoryStore(t), provider)
+	})
+}
+
+// statementStore records a statement like the SQL backends, and fails every
+// count
+type statementStore struct {
+	persistence.Store
+}
+
+func (s statementStore) GetPerson(ctx context.Context, uuid string) (*person.Person, error) {
+	Statement(ctx, "SELECT * FROM people WHERE uuid = $1")
+	return s.Store.GetPerson(ctx, uuid)
+}
+
+func (statementStore) GetPeopleCount(context.Context) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestStoreSpans(t *testing.T) {
+	provider, exporter := newProvider()
+	tracer := provider.Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "GET /pessoas/:id")
+
+	store := NewStore(statementStore{newMemoryStore(t)}, provider)
+
+	_, err := store.GetPerson(ctx, "unknown")
+	require.ErrorIs(t, err, persistence.ErrPersonNotFound)
+
+	_, err = store.GetPeopleCount(ctx)
+	require.Error(t, err)
+
+	parent.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+
+	get, count := spans[0], spans[1]
+
+	require.Equal(t, "store.GetPerson", get.Name)
+	require.Equal(t, parent.SpanContext().SpanID(), get.Parent.SpanID())
+	require.Contains(t, get.Attributes, attribute.String("db.statement", "SELECT * FROM people WHERE uuid = $1"))
+	// not finding the person is an answer
+	require.Equal(t, codes.Unset, get.Status.Code)
+
+	require.Equal(t, "store.GetPeopleCount", count.Name)
+	require.Equal(t, codes.Error, count.Status.Code)
+	require.Equal(t, "connection refused", count.Status.Description)
+}
+
+func TestCacheSpans(t *testing.T) {
+	ctx := context.Background()
+	provider, exporter := newProvider()
+
+	c := NewCache(cache.NewLRUCache(10, 0), provider)
+
+	require.NoError(t, c.Set(ctx, "person:1", []byte("value"), time.Minute))
+
+	value, err := c.Get(ctx, "person:1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	_, err = c.Get(ctx, "person:2")
+	require.ErrorIs(t, err, cache.ErrMiss)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+
+	require.Equal(t, "cache.Set", spans[0].Name)
+	require.Contains(t, spans[1].Attributes, attribute.Bool("cache.hit", true))
+	require.Contains(t, spans[2].Attributes, attribute.Bool("cache.hit", false))
+	require.Equal(t, codes.Unset, spans[2].Status.Code)
+}
@@ -28,3 +28,10 @@ func (p *Person) MarshalJSON() ([]byte, error) {
 }
 
 type People []*Person
+
+// Reverse reverses the order of the people in place
+func (people People) Reverse() {
+	for i, j := 0, len(people)-1; i < j; i, j = i+1, j-1 {
+		people[i], people[j] = people[j], people[i]
+	}
+}
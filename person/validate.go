@@ -0,0 +1,60 @@
+package person
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidName      = errors.New("Nome inválido")
+	ErrInvalidNickname  = errors.New("Apelido inválido")
+	ErrInvalidBirthdate = errors.New("Data de nascimento inválida")
+	ErrInvalidStack     = errors.New("Stack inválida")
+	ErrInvalidPerson    = errors.New("Pessoa inválida")
+)
+
+// Validate checks the fields of a person as sent by the clients
+func Validate(name string, nickname string, birthdate string, stack []string) error {
+	if name == "" || len(name) > 32 {
+		return ErrInvalidName
+	}
+
+	// nickname must contain only letters and spaces
+	if nickname == "" || len(nickname) > 75 || strings.ContainsAny(nickname, "0123456789!@#$%¨&*()_+{}^~:<>?/|\\") {
+		return ErrInvalidNickname
+	}
+
+	// birthdate must be in the format YYYY-MM-DD
+	if birthdate == "" {
+		return ErrInvalidBirthdate
+	}
+
+	for _, s := range stack {
+		if len(s) > 10 {
+			return ErrInvalidStack
+		}
+	}
+
+	return nil
+}
+
+// New validates the fields and builds the person they describe, without a
+// UUID
+func New(name string, nickname string, birthdate string, stack []string) (Person, error) {
+	parsed, err := time.Parse("2006-01-02", birthdate)
+	if err != nil {
+		return Person{}, ErrInvalidBirthdate
+	}
+
+	if err := Validate(name, nickname, birthdate, stack); err != nil {
+		return Person{}, err
+	}
+
+	return Person{
+		Name:      name,
+		Nickname:  nickname,
+		Birthdate: parsed,
+		Stack:     stack,
+	}, nil
+}
@@ -0,0 +1,43 @@
+// Package telemetry sets up the OpenTelemetry tracer provider the server and
+// the stores create their spans with.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+var ErrUnknownExporter = errors.New("unknown span exporter")
+
+// NewExporter returns the exporter called name. "otlp" sends the spans over
+// OTLP/HTTP to the endpoint of the OTEL_EXPORTER_OTLP_* variables, "stdout"
+// writes them to w as JSON. Tests export to a tracetest.InMemoryExporter.
+func NewExporter(ctx context.Context, name string, w io.Writer) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownExporter, name)
+	}
+}
+
+// NewTracerProvider exports the spans to exporter in batches. ratio of the
+// traces started by this service are sampled, the traces started by a caller
+// follow its sampling decision.
+func NewTracerProvider(exporter sdktrace.SpanExporter, serviceName string, ratio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+}
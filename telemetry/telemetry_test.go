@@ -0,0 +1,31 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdoutExporter(t *testing.T) {
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	exporter, err := NewExporter(ctx, "stdout", &out)
+	require.NoError(t, err)
+
+	provider := NewTracerProvider(exporter, "rinha-test", 1)
+
+	_, span := provider.Tracer("test").Start(ctx, "GET /pessoas")
+	span.End()
+
+	require.NoError(t, provider.Shutdown(ctx))
+	require.Contains(t, out.String(), `"Name":"GET /pessoas"`)
+	require.Contains(t, out.String(), `"Value":"rinha-test"`)
+}
+
+func TestUnknownExporter(t *testing.T) {
+	_, err := NewExporter(context.Background(), "jaeger", nil)
+	require.ErrorIs(t, err, ErrUnknownExporter)
+}